@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+//UserStats - items and storage used by the user
+type UserStats struct {
+	Items         int            `json:"items"`
+	DeletedItems  int            `json:"deleted_items"`
+	ContentTypes  map[string]int `json:"content_types"`
+	Size          int64          `json:"size"`
+	Revisions     int            `json:"revisions"`
+	RevisionsSize int64          `json:"revisions_size"`
+}
+
+//add - counts items of content type
+func (s *UserStats) add(contentType string, deleted bool, count int, size int64) {
+	s.Size += size
+	if deleted {
+		s.DeletedItems += count
+		return
+	}
+	s.Items += count
+	s.ContentTypes[contentType] += count
+}
+
+//userInfo - user as shown by admin commands
+type userInfo struct {
+	UUID      string    `json:"uuid"`
+	Email     string    `json:"email"`
+	Version   string    `json:"version"`
+	Disabled  bool      `json:"disabled"`
+	MFA       bool      `json:"mfa"`
+	Sessions  int       `json:"sessions"`
+	LastSync  time.Time `json:"last_sync"`
+	CreatedAt time.Time `json:"created_at"`
+	Stats     UserStats `json:"stats"`
+}
+
+//info - loads sessions, second factor and item stats of the user
+func (u User) info(store Store) (userInfo, error) {
+	info := userInfo{
+		UUID:      u.UUID,
+		Email:     u.Email,
+		Version:   u.Version,
+		Disabled:  u.Disabled,
+		CreatedAt: u.CreatedAt,
+	}
+	if info.Version == "" {
+		info.Version = "003"
+	}
+	sessions, err := store.UserSessions(u.UUID)
+	if err != nil {
+		return info, err
+	}
+	info.Sessions = len(sessions)
+	// sessions are touched by every request, latest one is the last sync
+	if len(sessions) > 0 {
+		info.LastSync = sessions[0].UpdatedAt
+	}
+	if m, err := store.MFAByUser(u.UUID); err == nil {
+		info.MFA = m.Enabled
+	}
+	info.Stats, err = store.UserStats(u.UUID)
+	return info, err
+}
+
+//SetDisabled - disables or enables the user, disabled user is signed out everywhere
+func (u *User) SetDisabled(store Store, disabled bool) error {
+	if err := store.SetUserDisabled(u.UUID, disabled); err != nil {
+		return err
+	}
+	u.Disabled = disabled
+	if disabled {
+		return store.DeleteUserSessions(u.UUID, "")
+	}
+	return nil
+}
+
+//userCommand - user list|show|disable|enable|delete|reset-sessions
+func userCommand(store Store, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: user list|show|disable|enable|delete|reset-sessions")
+	}
+	fs := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print as JSON")
+	fs.Parse(args[1:])
+
+	if args[0] == "list" {
+		users, err := store.Users()
+		if err != nil {
+			return err
+		}
+		infos := []userInfo{}
+		for _, u := range users {
+			info, err := u.info(store)
+			if err != nil {
+				return err
+			}
+			infos = append(infos, info)
+		}
+		if *asJSON {
+			return printJSON(os.Stdout, infos)
+		}
+		return printUsers(os.Stdout, infos)
+	}
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("Usage: user %s <email>", args[0])
+	}
+	email := fs.Arg(0)
+	user := NewUser()
+	if user.loadByEmail(store, email); user.UUID == "" {
+		return fmt.Errorf("Unknown user: %s", email)
+	}
+
+	switch args[0] {
+	case "show":
+		info, err := user.info(store)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(os.Stdout, info)
+		}
+		return printUser(os.Stdout, info)
+	case "disable":
+		if err := user.SetDisabled(store, true); err != nil {
+			return err
+		}
+		log.Println("Disabled", email)
+	case "enable":
+		if err := user.SetDisabled(store, false); err != nil {
+			return err
+		}
+		log.Println("Enabled", email)
+	case "delete":
+		if err := user.Delete(store); err != nil {
+			return err
+		}
+		log.Println("Deleted", email, "with all their data")
+	case "reset-sessions":
+		if err := store.DeleteUserSessions(user.UUID, ""); err != nil {
+			return err
+		}
+		log.Println("Signed out", email, "from all sessions")
+	default:
+		return fmt.Errorf("Unknown user command: %s", args[0])
+	}
+	return nil
+}
+
+func printUsers(w io.Writer, users []userInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tUUID\tITEMS\tSIZE\tLAST SYNC\tCREATED\tSTATUS")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", u.Email, u.UUID, u.Stats.Items, formatSize(u.Stats.Size+u.Stats.RevisionsSize), formatTime(u.LastSync), formatTime(u.CreatedAt), u.status())
+	}
+	return tw.Flush()
+}
+
+func printUser(w io.Writer, u userInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Email:\t%s\n", u.Email)
+	fmt.Fprintf(tw, "UUID:\t%s\n", u.UUID)
+	fmt.Fprintf(tw, "Status:\t%s\n", u.status())
+	fmt.Fprintf(tw, "Protocol:\t%s\n", u.Version)
+	fmt.Fprintf(tw, "Two-factor:\t%s\n", strconv.FormatBool(u.MFA))
+	fmt.Fprintf(tw, "Created:\t%s\n", formatTime(u.CreatedAt))
+	fmt.Fprintf(tw, "Last sync:\t%s\n", formatTime(u.LastSync))
+	fmt.Fprintf(tw, "Sessions:\t%d\n", u.Sessions)
+	fmt.Fprintf(tw, "Items:\t%d (%d deleted)\n", u.Stats.Items, u.Stats.DeletedItems)
+	types := make([]string, 0, len(u.Stats.ContentTypes))
+	for t := range u.Stats.ContentTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(tw, "  %s:\t%d\n", t, u.Stats.ContentTypes[t])
+	}
+	fmt.Fprintf(tw, "Revisions:\t%d\n", u.Stats.Revisions)
+	fmt.Fprintf(tw, "Storage used:\t%s (revisions %s)\n", formatSize(u.Stats.Size+u.Stats.RevisionsSize), formatSize(u.Stats.RevisionsSize))
+	return tw.Flush()
+}
+
+func (u userInfo) status() string {
+	if u.Disabled {
+		return "disabled"
+	}
+	return "active"
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+//formatSize - bytes in human readable units
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	apiTokenPrefix  = "sfat_"
+	scopeItemsRead  = "items:read"
+	scopeItemsWrite = "items:write"
+	scopeBackup     = "backup"
+)
+
+//apiScopes - scopes API tokens can be created with
+var apiScopes = []string{scopeItemsRead, scopeItemsWrite, scopeBackup}
+
+//APIToken - personal token for scripts, limited to its scopes. Only hash of the token is stored
+type APIToken struct {
+	UUID       string    `json:"uuid"`
+	UserUUID   string    `json:"-"            sql:"user_uuid"`
+	Name       string    `json:"name"`
+	TokenHash  string    `json:"-"            sql:"token_hash"`
+	Scopes     string    `json:"scopes"`
+	ExpiresAt  time.Time `json:"expires_at"   sql:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at" sql:"last_used_at"`
+	CreatedAt  time.Time `json:"created_at"   sql:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"   sql:"updated_at"`
+}
+
+//APITokens - list of API tokens
+type APITokens []APIToken
+
+//scopeError - API token is not allowed to use the route
+type scopeError struct {
+	scopes []string
+}
+
+func (e scopeError) Error() string {
+	if len(e.scopes) == 0 {
+		return "API tokens can't be used for this request, sign in instead"
+	}
+	return "API token is missing required scope: " + strings.Join(e.scopes, ", ")
+}
+
+//CreateAPIToken - creates token with given scopes, zero expiresAt means it doesn't expire. Token is returned only once
+func (u User) CreateAPIToken(store Store, name string, scopes []string, expiresAt time.Time) (APIToken, string, error) {
+	if len(scopes) == 0 {
+		return APIToken{}, "", fmt.Errorf("At least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !hasScope(strings.Join(apiScopes, " "), scope) {
+			return APIToken{}, "", fmt.Errorf("Unknown scope: %s", scope)
+		}
+	}
+	if !expiresAt.IsZero() && expiresAt.Before(time.Now()) {
+		return APIToken{}, "", fmt.Errorf("Expiration is in the past")
+	}
+	secret, err := randomBytes(32)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	t := APIToken{
+		UUID:      uuid.Must(uuid.NewV4()).String(),
+		UserUUID:  u.UUID,
+		Name:      name,
+		TokenHash: hashToken(token),
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := store.CreateAPIToken(&t); err != nil {
+		return APIToken{}, "", err
+	}
+	return t, token, nil
+}
+
+//GetAPITokens - API tokens of the user
+func (u User) GetAPITokens(store Store) (APITokens, error) {
+	return store.UserAPITokens(u.UUID)
+}
+
+//RevokeAPIToken - deletes API token of the user
+func (u User) RevokeAPIToken(store Store, uuid string) error {
+	return store.DeleteAPIToken(u.UUID, uuid)
+}
+
+//authenticateAPIToken - returns owner of the token if it has all scopes
+func authenticateAPIToken(store Store, token string, scopes []string) (User, error) {
+	user := NewUser()
+	if len(scopes) == 0 {
+		return user, scopeError{}
+	}
+	t, err := store.APITokenByHash(hashToken(token))
+	if err != nil || (!t.ExpiresAt.IsZero() && t.ExpiresAt.Before(time.Now())) {
+		return user, fmt.Errorf("Invalid token")
+	}
+	if ok := user.LoadByUUID(store, t.UserUUID); !ok || user.Disabled {
+		return user, fmt.Errorf("Unknown user")
+	}
+	missing := []string{}
+	for _, scope := range scopes {
+		if !hasScope(t.Scopes, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return user, scopeError{missing}
+	}
+	if time.Since(t.LastUsedAt) > seenInterval {
+		t.LastUsedAt = time.Now()
+		if err := store.UpdateAPIToken(&t); err != nil {
+			Log("API token update failed:", err)
+		}
+	}
+	return user, nil
+}
+
+//hasScope - scopes are space separated
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+//itemFilter - selects items for backup
+type itemFilter struct {
+	ContentTypes []string
+	Deleted      bool
+}
+
+//newItemFilter - reads content_type (repeated or comma separated) and deleted from request,
+//deleted items are skipped unless deleted=true is given
+func newItemFilter(r *http.Request) itemFilter {
+	filter := itemFilter{Deleted: r.FormValue("deleted") == "true"}
+	for _, value := range r.Form["content_type"] {
+		for _, t := range strings.Split(value, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				filter.ContentTypes = append(filter.ContentTypes, t)
+			}
+		}
+	}
+	return filter
+}
+
+func (f itemFilter) matches(i Item) bool {
+	if i.Deleted != f.Deleted {
+		return false
+	}
+	if len(f.ContentTypes) == 0 {
+		return true
+	}
+	for _, t := range f.ContentTypes {
+		if i.ContentType == t {
+			return true
+		}
+	}
+	return false
+}
+
+//WriteBackup - writes user's items and auth params in the format of Standard Notes encrypted backup file.
+//Items are streamed one by one
+func (u User) WriteBackup(store Store, w io.Writer, filter itemFilter) error {
+	if _, err := io.WriteString(w, `{"items":[`); err != nil {
+		return err
+	}
+	first := true
+	err := store.EachItem(u.UUID, filter, func(i Item) error {
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		content, err := json.Marshal(i)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	params, err := u.GetParams(store, u.Email)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, `],"auth_params":`+string(content)+"}\n")
+	return err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+
+	"github.com/tectiv3/standardfile/db"
+)
+
+//commands - admin subcommands working on the configured database
+var commands = map[string]func(store Store, args []string) error{
+	"invite": inviteCommand,
+	"user":   userCommand,
+	"key":    keyCommand,
+	"backup": backupCommand,
+}
+
+//runCommand - runs subcommand given after flags, e.g. standardfile -c standardfile.json invite list
+func runCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		log.Fatal("Unknown command: ", args[0])
+	}
+	db.Init(cfg.DBDriver, dbDSN())
+	runMigrations()
+	store := NewSQLStore(db.Default())
+	if err := cmd(store, args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
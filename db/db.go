@@ -2,16 +2,29 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/kisielk/sqlstruct"
+	//importing init from postgres
+	_ "github.com/lib/pq"
 	//importing init from sqlite3
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const schema string = `
+const (
+	//SQLite driver name
+	SQLite = "sqlite3"
+	//Postgres driver name
+	Postgres = "postgres"
+)
+
+const sqliteSchema string = `
 PRAGMA foreign_keys=OFF;
 BEGIN TRANSACTION;
 CREATE TABLE IF NOT EXISTS "items" (
@@ -22,6 +35,7 @@ CREATE TABLE IF NOT EXISTS "items" (
     "enc_item_key" varchar(255) NOT NULL,
     "auth_hash" varchar(255) NOT NULL,
     "deleted" integer(1) NOT NULL DEFAULT 0,
+    "change_seq" integer NOT NULL DEFAULT 0,
     "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
     "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
 CREATE TABLE IF NOT EXISTS "users" (
@@ -35,18 +49,172 @@ CREATE TABLE IF NOT EXISTS "users" (
     "pw_nonce" varchar(255) NOT NULL,
     "pw_auth" varchar(255) NOT NULL,
     "pw_salt" varchar(255) NOT NULL,
+    "version" varchar(255) NOT NULL DEFAULT '',
+    "change_seq" integer NOT NULL DEFAULT 0,
+    "disabled" integer(1) NOT NULL DEFAULT 0,
     "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
     "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
-CREATE INDEX IF NOT EXISTS user_uuid ON items (user_uuid);
+CREATE TABLE IF NOT EXISTS "revisions" (
+    "uuid" varchar(36) primary key NULL,
+    "item_uuid" varchar(36) NOT NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "content" blob NOT NULL,
+    "content_type" varchar(255) NOT NULL,
+    "enc_item_key" varchar(255) NOT NULL,
+    "auth_hash" varchar(255) NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "sessions" (
+    "uuid" varchar(36) primary key NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "api" varchar(255) NOT NULL DEFAULT '',
+    "user_agent" text NOT NULL DEFAULT '',
+    "device" varchar(255) NOT NULL DEFAULT '',
+    "ip" varchar(255) NOT NULL DEFAULT '',
+    "refresh_hash" varchar(255) NOT NULL DEFAULT '',
+    "refresh_expires_at" timestamp,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "mfa" (
+    "uuid" varchar(36) primary key NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "secret" varchar(255) NOT NULL,
+    "recovery_codes" text NOT NULL DEFAULT '',
+    "enabled" integer(1) NOT NULL DEFAULT 0,
+    "last_step" integer NOT NULL DEFAULT 0,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "invites" (
+    "code" varchar(64) primary key NULL,
+    "max_uses" integer NOT NULL DEFAULT 0,
+    "uses" integer NOT NULL DEFAULT 0,
+    "expires_at" timestamp,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "api_tokens" (
+    "uuid" varchar(36) primary key NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "name" varchar(255) NOT NULL DEFAULT '',
+    "token_hash" varchar(64) NOT NULL,
+    "scopes" varchar(255) NOT NULL,
+    "expires_at" timestamp,
+    "last_used_at" timestamp,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "settings" (
+    "user_uuid" varchar(36) primary key NULL,
+    "email_backups" integer(1) NOT NULL DEFAULT 0,
+    "sign_in_alerts" integer(1) NOT NULL DEFAULT 1,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP);
+CREATE UNIQUE INDEX IF NOT EXISTS user_item ON items (user_uuid, uuid);
 CREATE INDEX IF NOT EXISTS user_content on items (user_uuid, content_type);
 CREATE INDEX IF NOT EXISTS updated_at on items (updated_at);
+CREATE INDEX IF NOT EXISTS user_updated_at on items (user_uuid, updated_at, uuid);
 CREATE INDEX IF NOT EXISTS email on users (email);
+CREATE INDEX IF NOT EXISTS item_revisions on revisions (user_uuid, item_uuid, created_at);
+CREATE INDEX IF NOT EXISTS user_sessions on sessions (user_uuid, updated_at);
+CREATE UNIQUE INDEX IF NOT EXISTS user_mfa on mfa (user_uuid);
+CREATE UNIQUE INDEX IF NOT EXISTS api_token_hash on api_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS user_api_tokens on api_tokens (user_uuid);
 COMMIT;
 `
 
+const postgresSchema string = `
+CREATE TABLE IF NOT EXISTS "items" (
+    "uuid" varchar(36) primary key,
+    "user_uuid" varchar(36) NOT NULL,
+    "content" text NOT NULL,
+    "content_type" varchar(255) NOT NULL,
+    "enc_item_key" text NOT NULL,
+    "auth_hash" varchar(255) NOT NULL,
+    "deleted" boolean NOT NULL DEFAULT false,
+    "change_seq" bigint NOT NULL DEFAULT 0,
+    "created_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "users" (
+    "uuid" varchar(36) primary key,
+    "email" varchar(255) NOT NULL,
+    "password" varchar(255) NOT NULL,
+    "pw_func" varchar(255) NOT NULL DEFAULT 'pbkdf2',
+    "pw_alg" varchar(255) NOT NULL DEFAULT 'sha512',
+    "pw_cost" integer NOT NULL DEFAULT 5000,
+    "pw_key_size" integer NOT NULL DEFAULT 512,
+    "pw_nonce" varchar(255) NOT NULL,
+    "pw_auth" varchar(255) NOT NULL,
+    "pw_salt" varchar(255) NOT NULL,
+    "version" varchar(255) NOT NULL DEFAULT '',
+    "change_seq" bigint NOT NULL DEFAULT 0,
+    "disabled" boolean NOT NULL DEFAULT false,
+    "created_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "revisions" (
+    "uuid" varchar(36) primary key,
+    "item_uuid" varchar(36) NOT NULL,
+    "user_uuid" varchar(36) NOT NULL,
+    "content" text NOT NULL,
+    "content_type" varchar(255) NOT NULL,
+    "enc_item_key" text NOT NULL,
+    "auth_hash" varchar(255) NOT NULL,
+    "created_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "sessions" (
+    "uuid" varchar(36) primary key,
+    "user_uuid" varchar(36) NOT NULL,
+    "api" varchar(255) NOT NULL DEFAULT '',
+    "user_agent" text NOT NULL DEFAULT '',
+    "device" varchar(255) NOT NULL DEFAULT '',
+    "ip" varchar(255) NOT NULL DEFAULT '',
+    "refresh_hash" varchar(255) NOT NULL DEFAULT '',
+    "refresh_expires_at" timestamp with time zone,
+    "created_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "mfa" (
+    "uuid" varchar(36) primary key,
+    "user_uuid" varchar(36) NOT NULL,
+    "secret" varchar(255) NOT NULL,
+    "recovery_codes" text NOT NULL DEFAULT '',
+    "enabled" boolean NOT NULL DEFAULT false,
+    "last_step" bigint NOT NULL DEFAULT 0,
+    "created_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "invites" (
+    "code" varchar(64) primary key,
+    "max_uses" integer NOT NULL DEFAULT 0,
+    "uses" integer NOT NULL DEFAULT 0,
+    "expires_at" timestamp with time zone,
+    "created_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "api_tokens" (
+    "uuid" varchar(36) primary key,
+    "user_uuid" varchar(36) NOT NULL,
+    "name" varchar(255) NOT NULL DEFAULT '',
+    "token_hash" varchar(64) NOT NULL,
+    "scopes" varchar(255) NOT NULL,
+    "expires_at" timestamp with time zone,
+    "last_used_at" timestamp with time zone,
+    "created_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "updated_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP);
+CREATE TABLE IF NOT EXISTS "settings" (
+    "user_uuid" varchar(36) primary key,
+    "email_backups" boolean NOT NULL DEFAULT false,
+    "sign_in_alerts" boolean NOT NULL DEFAULT true,
+    "updated_at" timestamp with time zone DEFAULT CURRENT_TIMESTAMP);
+CREATE UNIQUE INDEX IF NOT EXISTS user_item ON items (user_uuid, uuid);
+CREATE INDEX IF NOT EXISTS user_content on items (user_uuid, content_type);
+CREATE INDEX IF NOT EXISTS updated_at on items (updated_at);
+CREATE INDEX IF NOT EXISTS user_updated_at on items (user_uuid, updated_at, uuid);
+CREATE INDEX IF NOT EXISTS email on users (email);
+CREATE INDEX IF NOT EXISTS item_revisions on revisions (user_uuid, item_uuid, created_at);
+CREATE INDEX IF NOT EXISTS user_sessions on sessions (user_uuid, updated_at);
+CREATE UNIQUE INDEX IF NOT EXISTS user_mfa on mfa (user_uuid);
+CREATE UNIQUE INDEX IF NOT EXISTS api_token_hash on api_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS user_api_tokens on api_tokens (user_uuid);
+`
+
 //Database encapsulates database
 type Database struct {
-	db *sql.DB
+	db     *sql.DB
+	driver string
 }
 
 //DB returns DB handler
@@ -54,66 +222,208 @@ func DB() *sql.DB {
 	return database.db
 }
 
-func (db Database) begin() (tx *sql.Tx) {
-	tx, err := db.db.Begin()
+//Driver returns name of the driver in use
+func Driver() string {
+	return database.driver
+}
+
+func (db Database) begin() (tx *sql.Tx, err error) {
+	tx, err = db.db.Begin()
 	if err != nil {
 		log.Println(err)
-		return nil
+		return nil, err
 	}
-	return tx
+	return tx, nil
 }
 
-func (db Database) prepare(q string) (stmt *sql.Stmt) {
+func (db Database) prepare(q string) (stmt *sql.Stmt, err error) {
 	// log.Println("Query:", q)
-	stmt, err := db.db.Prepare(q)
+	stmt, err = db.db.Prepare(db.rebind(q))
 	if err != nil {
 		log.Println(err)
-		return nil
+		return nil, err
 	}
-	return stmt
+	return stmt, nil
 }
 
-func (db Database) createTables() {
+func (db Database) createTables() error {
+	schema := sqliteSchema
+	if db.driver == Postgres {
+		schema = postgresSchema
+	}
 	// create table if not exists
-	_, err = db.db.Exec(schema)
-	if err != nil {
-		panic(err)
+	_, err := db.db.Exec(schema)
+	return err
+}
+
+//rebind converts query written for sqlite into the dialect of current driver
+func (db Database) rebind(q string) string {
+	if db.driver != Postgres {
+		return q
 	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+			b.WriteRune(r)
+		case quoted:
+			b.WriteRune(r)
+		case r == '`':
+			b.WriteRune('"')
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+//Rebind converts query with ? placeholders and backtick quoting to the current driver dialect
+func Rebind(q string) string {
+	return database.rebind(q)
 }
 
 var database Database
-var err error
 
-//Init opens DB connection
-func Init(dbpath string) {
-	database.db, err = sql.Open("sqlite3", dbpath+"?loc=auto&parseTime=true")
-	// database.db, err = sql.Open("mysql", "Username:Password@tcp(Host:Port)/standardfile?parseTime=true")
+//Open opens DB connection and creates tables
+func Open(driver, dsn string) (*Database, error) {
+	switch driver {
+	case "", SQLite:
+		driver = SQLite
+		if strings.Contains(dsn, "?") {
+			dsn = dsn + "&loc=auto&parseTime=true"
+		} else {
+			dsn = dsn + "?loc=auto&parseTime=true"
+		}
+	case Postgres, "postgresql":
+		driver = Postgres
+	default:
+		return nil, fmt.Errorf("Unsupported db driver: %s", driver)
+	}
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := &Database{db: conn, driver: driver}
+	if err := d.createTables(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return d, nil
+}
 
+//Init opens default DB connection
+func Init(driver, dsn string) {
+	d, err := Open(driver, dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if database.db == nil {
-		log.Fatal("db nil")
+	database = *d
+}
+
+//Default returns default database opened by Init
+func Default() *Database {
+	return &database
+}
+
+//ErrNoSnapshot is returned by Snapshot for databases other than sqlite
+var ErrNoSnapshot = errors.New("Snapshots are supported for sqlite only, use pg_dump to back up postgres")
+
+//Snapshot writes consistent copy of the database to a new file at path
+func (db Database) Snapshot(path string) error {
+	if db.driver != SQLite {
+		return ErrNoSnapshot
 	}
-	database.createTables()
+	_, err := db.db.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+//CheckIntegrity runs integrity check of sqlite database file at path
+func CheckIntegrity(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	conn, err := sql.Open(SQLite, path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := conn.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	problems := []string{}
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+//HasColumn checks if table has given column
+func (db Database) HasColumn(table, column string) (bool, error) {
+	return db.hasColumn(db.db, table, column)
+}
+
+//rowQuerier - connection pool or transaction
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (db Database) hasColumn(q rowQuerier, table, column string) (bool, error) {
+	query := "SELECT count(*) FROM pragma_table_info(?) WHERE name=?"
+	if db.driver == Postgres {
+		query = "SELECT count(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name=? AND column_name=?"
+	}
+	var count int
+	if err := q.QueryRow(db.rebind(query), table, column).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
 }
 
 //Query db function
-func Query(sql string, args ...interface{}) error {
-	stmt := database.prepare(sql)
+func (db Database) Query(sql string, args ...interface{}) error {
+	stmt, err := db.prepare(sql)
+	if err != nil {
+		return err
+	}
 	defer stmt.Close()
-	tx := database.begin()
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
 	if _, err := tx.Stmt(stmt).Exec(args...); err != nil {
 		log.Println("Query error: ", err)
 		tx.Rollback()
+		return err
 	}
-	err := tx.Commit()
-	return err
+	return tx.Commit()
 }
 
 //SelectFirst - selects first result from a row
-func SelectFirst(sql string, args ...interface{}) (interface{}, error) {
-	stmt := database.prepare(sql)
+func (db Database) SelectFirst(sql string, args ...interface{}) (interface{}, error) {
+	stmt, err := db.prepare(sql)
+	if err != nil {
+		return nil, err
+	}
 	defer stmt.Close()
 	var result string
 	err = stmt.QueryRow(args...).Scan(&result)
@@ -124,24 +434,20 @@ func SelectFirst(sql string, args ...interface{}) (interface{}, error) {
 }
 
 //SelectStruct - returns selected result as struct
-func SelectStruct(sql string, obj interface{}, args ...interface{}) (interface{}, error) {
+func (db Database) SelectStruct(sql string, obj interface{}, args ...interface{}) (interface{}, error) {
 	destv := reflect.ValueOf(obj)
-	elem := destv.Elem()
-	typeOfObj := elem.Type()
 
-	var values []interface{}
-	for i := 0; i < elem.NumField(); i++ {
-		values = append(values, elem.FieldByName(typeOfObj.Field(i).Name).Addr().Interface())
+	stmt, err := db.prepare(sql)
+	if err != nil {
+		return nil, err
 	}
-
-	stmt := database.prepare(sql)
 	defer stmt.Close()
 
 	rows, err := stmt.Query(args...)
-	defer rows.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		err = sqlstruct.Scan(destv.Interface(), rows)
 	}
@@ -149,13 +455,141 @@ func SelectStruct(sql string, obj interface{}, args ...interface{}) (interface{}
 }
 
 //Select - selects multiple results from the DB
-func Select(sql string, out interface{}, args ...interface{}) (err error) {
-	stmt := database.prepare(sql)
+func (db Database) Select(sql string, out interface{}, args ...interface{}) (err error) {
+	stmt, err := db.prepare(sql)
+	if err != nil {
+		return err
+	}
 	defer stmt.Close()
 
 	rows, err := stmt.Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return scanAll(rows, out)
+}
+
+//Each - runs fn for every selected row, rows are not loaded into memory at once
+func (db Database) Each(sql string, fn func(rows *sql.Rows) error, args ...interface{}) error {
+	stmt, err := db.prepare(sql)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//Begin starts transaction
+func (db Database) Begin() (*Tx, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx, db: db, stmts: map[string]*sql.Stmt{}}, nil
+}
+
+//Transaction runs fn inside of transaction, which is rolled back if fn returns error
+func (db Database) Transaction(fn func(tx *Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//Tx - database transaction, queries are converted to the driver dialect
+//and prepared once for the lifetime of transaction
+type Tx struct {
+	tx    *sql.Tx
+	db    Database
+	stmts map[string]*sql.Stmt
+}
+
+//Commit commits transaction
+func (tx *Tx) Commit() error {
+	defer tx.closeStmts()
+	return tx.tx.Commit()
+}
+
+//Rollback aborts transaction
+func (tx *Tx) Rollback() error {
+	defer tx.closeStmts()
+	return tx.tx.Rollback()
+}
+
+func (tx *Tx) closeStmts() {
+	for _, stmt := range tx.stmts {
+		stmt.Close()
+	}
+	tx.stmts = map[string]*sql.Stmt{}
+}
+
+//Prepare returns prepared statement bound to transaction, statements are reused
+func (tx *Tx) Prepare(sql string) (*sql.Stmt, error) {
+	if stmt, ok := tx.stmts[sql]; ok {
+		return stmt, nil
+	}
+	stmt, err := tx.tx.Prepare(tx.db.rebind(sql))
+	if err != nil {
+		return nil, err
+	}
+	tx.stmts[sql] = stmt
+	return stmt, nil
+}
+
+//Exec executes query within transaction
+func (tx *Tx) Exec(sql string, args ...interface{}) (sql.Result, error) {
+	stmt, err := tx.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+//SelectFirst - selects first result from a row within transaction
+func (tx *Tx) SelectFirst(sql string, args ...interface{}) (interface{}, error) {
+	stmt, err := tx.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	var result string
+	if err := stmt.QueryRow(args...).Scan(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//Select - selects multiple results within transaction
+func (tx *Tx) Select(sql string, out interface{}, args ...interface{}) error {
+	stmt, err := tx.Prepare(sql)
+	if err != nil {
+		return err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
+	return scanAll(rows, out)
+}
 
+func scanAll(rows *sql.Rows, out interface{}) (err error) {
 	results := indirect(reflect.ValueOf(out))
 	resultType := results.Type().Elem()
 	isPtr := false
@@ -184,6 +618,41 @@ func Select(sql string, out interface{}, args ...interface{}) (err error) {
 	return err
 }
 
+//HasColumn checks if table of default database has given column
+func HasColumn(table, column string) (bool, error) {
+	return database.HasColumn(table, column)
+}
+
+//HasColumnTx - checks column of default database within transaction, so columns added earlier in it are seen
+func HasColumnTx(tx *sql.Tx, table, column string) (bool, error) {
+	return database.hasColumn(tx, table, column)
+}
+
+//Query runs query on default database
+func Query(sql string, args ...interface{}) error {
+	return database.Query(sql, args...)
+}
+
+//SelectFirst - selects first result from a row of default database
+func SelectFirst(sql string, args ...interface{}) (interface{}, error) {
+	return database.SelectFirst(sql, args...)
+}
+
+//SelectStruct - returns selected result from default database as struct
+func SelectStruct(sql string, obj interface{}, args ...interface{}) (interface{}, error) {
+	return database.SelectStruct(sql, obj, args...)
+}
+
+//Select - selects multiple results from default database
+func Select(sql string, out interface{}, args ...interface{}) error {
+	return database.Select(sql, out, args...)
+}
+
+//Each - runs fn for every row selected from default database
+func Each(sql string, fn func(rows *sql.Rows) error, args ...interface{}) error {
+	return database.Each(sql, fn, args...)
+}
+
 func indirect(reflectValue reflect.Value) reflect.Value {
 	for reflectValue.Kind() == reflect.Ptr {
 		reflectValue = reflectValue.Elem()
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tectiv3/standardfile/db/pgtest"
+)
+
+type testItem struct {
+	UUID      string    `sql:"uuid"`
+	UserUUID  string    `sql:"user_uuid"`
+	Content   string    `sql:"content"`
+	Deleted   bool      `sql:"deleted"`
+	UpdatedAt time.Time `sql:"updated_at"`
+}
+
+func TestRebind(t *testing.T) {
+	pg := Database{driver: Postgres}
+	q := pg.rebind("UPDATE `items` SET `content`='?', `deleted`=? WHERE `uuid`=? AND `user_uuid`=?")
+	expected := `UPDATE "items" SET "content"='?', "deleted"=$1 WHERE "uuid"=$2 AND "user_uuid"=$3`
+	if q != expected {
+		t.Errorf("Unexpected query: %s", q)
+	}
+
+	lite := Database{driver: SQLite}
+	if q := lite.rebind("SELECT * FROM `items` WHERE `uuid`=?"); q != "SELECT * FROM `items` WHERE `uuid`=?" {
+		t.Errorf("sqlite query should not change: %s", q)
+	}
+}
+
+// TestPostgres runs against temporary cluster started with initdb and pg_ctl from PATH,
+// or against existing server, e.g.
+// SF_TEST_POSTGRES_DSN="postgres://postgres@localhost/sf_test?sslmode=disable" go test ./db
+func TestPostgres(t *testing.T) {
+	dsn, stop, err := pgtest.Start()
+	if errors.Is(err, pgtest.ErrUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	Init(Postgres, dsn)
+	defer DB().Exec(`DELETE FROM "items" WHERE "user_uuid"='pg-test-user'`)
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	err = Query("INSERT INTO `items` (`uuid`, `user_uuid`, content, content_type, enc_item_key, auth_hash, deleted, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?,?)",
+		"pg-test-item", "pg-test-user", "content", "Note", "key", "hash", false, now, now)
+	if err != nil {
+		t.Fatal("Insert failed:", err)
+	}
+	if err := Query("UPDATE `items` SET `content`='', `deleted`=? WHERE `uuid`=?", true, "pg-test-item"); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+
+	uuid, err := SelectFirst("SELECT `uuid` FROM `items` WHERE `user_uuid`=?", "pg-test-user")
+	if err != nil || uuid != "pg-test-item" {
+		t.Fatal("SelectFirst failed:", uuid, err)
+	}
+
+	item := testItem{}
+	if _, err := SelectStruct("SELECT * FROM `items` WHERE `uuid`=?", &item, "pg-test-item"); err != nil {
+		t.Fatal("SelectStruct failed:", err)
+	}
+	if !item.Deleted || item.Content != "" || !item.UpdatedAt.Equal(now) {
+		t.Errorf("Unexpected item: %+v", item)
+	}
+
+	items := []testItem{}
+	if err := Select("SELECT * FROM `items` WHERE `user_uuid`=? AND `updated_at` >= ?", &items, "pg-test-user", now); err != nil {
+		t.Fatal("Select failed:", err)
+	}
+	if len(items) != 1 {
+		t.Errorf("Expected 1 item, got %d", len(items))
+	}
+
+	if ok, err := HasColumn("users", "pw_salt"); !ok || err != nil {
+		t.Error("HasColumn failed:", err)
+	}
+	testHasColumnTx(t)
+}
+
+func TestHasColumnTx(t *testing.T) {
+	Init(SQLite, filepath.Join(t.TempDir(), "sf.db"))
+	testHasColumnTx(t)
+}
+
+//testHasColumnTx - column added by migration is seen within its transaction only
+func testHasColumnTx(t *testing.T) {
+	tx, err := DB().Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if ok, err := HasColumnTx(tx, "items", "tx_column"); ok || err != nil {
+		t.Fatal("Column should not exist yet:", err)
+	}
+	if _, err := tx.Exec("ALTER TABLE items ADD COLUMN tx_column integer"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := HasColumnTx(tx, "items", "tx_column"); !ok || err != nil {
+		t.Error("Column added within transaction should be seen:", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open(SQLite, filepath.Join(dir, "sf.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Query("INSERT INTO `items` (`uuid`, `user_uuid`, `content`, `content_type`, `enc_item_key`, `auth_hash`) VALUES(?,?,?,?,?,?)", "snapshot-1", "user", "001abc", "Note", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "copy.db")
+	if err := d.Snapshot(target); err != nil {
+		t.Fatal("Snapshot failed:", err)
+	}
+	if err := CheckIntegrity(target); err != nil {
+		t.Error("Snapshot should pass integrity check:", err)
+	}
+	if err := d.Snapshot(target); err == nil {
+		t.Error("Snapshot should not overwrite existing file")
+	}
+
+	broken := filepath.Join(dir, "broken.db")
+	ioutil.WriteFile(broken, []byte("not a database"), 0600)
+	if err := CheckIntegrity(broken); err == nil {
+		t.Error("Broken file should fail integrity check")
+	}
+	if err := CheckIntegrity(filepath.Join(dir, "missing.db")); err == nil {
+		t.Error("Missing file should fail integrity check")
+	}
+	if err := (Database{driver: Postgres}).Snapshot(target); err != ErrNoSnapshot {
+		t.Error("Snapshots should be sqlite only:", err)
+	}
+}
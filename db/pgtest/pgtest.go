@@ -0,0 +1,83 @@
+//Package pgtest provides PostgreSQL server for tests of both sql drivers
+package pgtest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//ErrUnavailable is returned by Start when there is neither server to use nor binaries to start one, tests are skipped then
+var ErrUnavailable = errors.New("postgres is not available, set SF_TEST_POSTGRES_DSN or put initdb and pg_ctl in PATH")
+
+//Start - returns dsn of SF_TEST_POSTGRES_DSN or starts temporary cluster with initdb and pg_ctl.
+//The cluster listens on free local port and is removed by the returned stop function
+func Start() (dsn string, stop func(), err error) {
+	if dsn := os.Getenv("SF_TEST_POSTGRES_DSN"); dsn != "" {
+		return dsn, func() {}, nil
+	}
+	initdb, pgctl := binary("initdb"), binary("pg_ctl")
+	if initdb == "" || pgctl == "" {
+		return "", nil, ErrUnavailable
+	}
+	if os.Geteuid() == 0 {
+		return "", nil, fmt.Errorf("%w: initdb refuses to run as root", ErrUnavailable)
+	}
+	port, err := freePort()
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := ioutil.TempDir("", "sf-postgres")
+	if err != nil {
+		return "", nil, err
+	}
+	data := filepath.Join(dir, "data")
+	if out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "-A", "trust", "-E", "UTF8").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("initdb failed: %v\n%s", err, out)
+	}
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1 -c fsync=off", port, dir)
+	if out, err := exec.Command(pgctl, "-D", data, "-l", filepath.Join(dir, "log"), "-o", options, "-w", "start").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("pg_ctl start failed: %v\n%s", err, out)
+	}
+	stop = func() {
+		exec.Command(pgctl, "-D", data, "-m", "immediate", "-w", "stop").Run()
+		os.RemoveAll(dir)
+	}
+	return fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port), stop, nil
+}
+
+//binary - finds postgres binary in PATH or in versioned directories of debian packages, newest first
+func binary(name string) string {
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+	dirs, _ := filepath.Glob("/usr/lib/postgresql/*/bin")
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+	port := 0
+	_, err = fmt.Sscanf(addr[strings.LastIndex(addr, ":")+1:], "%d", &port)
+	return port, err
+}
@@ -12,12 +12,13 @@ require (
 	github.com/heetch/confita v0.10.0
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
 	github.com/kisielk/sqlstruct v0.0.0-20210630145711-dae28ed37023
-	github.com/lib/pq v1.1.1 // indirect
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.15
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/remind101/migrate v0.0.0-20170729031349-52c1edff7319
 	github.com/satori/go.uuid v0.0.0-20180103174451-36e9d2ebbde5
 	github.com/sevlyar/go-daemon v0.1.6
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
 	golang.org/x/sys v0.0.0-20220907062415-87db552b00fd // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"github.com/tectiv3/standardfile/db"
+)
+
+const (
+	importSkip      = "skip"
+	importOverwrite = "overwrite"
+	importDuplicate = "duplicate"
+)
+
+//errEncryptedDuplicate - uuid of encrypted item is authenticated (003 auth_hash, 004 additional data),
+//copy under new uuid could not be decrypted by clients
+var errEncryptedDuplicate = errors.New("Encrypted item can't be duplicated, its uuid is authenticated and copy under new uuid couldn't be decrypted")
+
+//backupFile - encrypted backup exported by Standard Notes apps or Standard File servers
+type backupFile struct {
+	Items      Items                  `json:"items"`
+	AuthParams map[string]interface{} `json:"auth_params"`
+}
+
+//ImportResult - outcome of importing backup file
+type ImportResult struct {
+	Saved   Items     `json:"saved_items"`
+	Unsaved []unsaved `json:"unsaved"`
+	Skipped []string  `json:"skipped"`
+}
+
+func readBackup(r io.Reader) (backupFile, error) {
+	backup := backupFile{}
+	if err := json.NewDecoder(r).Decode(&backup); err != nil {
+		return backup, fmt.Errorf("Invalid backup file: %v", err)
+	}
+	return backup, nil
+}
+
+//Import - saves items from backup using the sync save path. onConflict decides what happens
+//when item uuid already exists: skip keeps existing item, overwrite replaces it,
+//duplicate saves imported item under a new uuid. Only unencrypted items (content starting with 000) can be duplicated,
+//encrypted ones are reported unsaved
+func (u User) Import(store Store, items Items, onConflict string) (ImportResult, error) {
+	result := ImportResult{Saved: Items{}, Unsaved: []unsaved{}, Skipped: []string{}}
+	switch onConflict {
+	case "":
+		onConflict = importSkip
+	case importSkip, importOverwrite, importDuplicate:
+	default:
+		return result, fmt.Errorf("Unknown conflict option: %s", onConflict)
+	}
+
+	accepted := Items{}
+	for _, item := range items {
+		// deleted items carry no content to restore
+		if item.Deleted || item.UUID == "" {
+			result.Skipped = append(result.Skipped, item.UUID)
+			continue
+		}
+		owner, err := store.ItemOwner(item.UUID)
+		if err != nil && err != errNotFound {
+			return result, err
+		}
+		if err == nil {
+			switch {
+			case onConflict == importDuplicate && !strings.HasPrefix(item.Content, "000"):
+				item.UserUUID = u.UUID
+				result.Unsaved = append(result.Unsaved, unsaved{item, errEncryptedDuplicate})
+				continue
+			case onConflict == importDuplicate:
+				Log("Import duplicate:", item.UUID)
+				item.UUID = uuid.Must(uuid.NewV4()).String()
+			case onConflict == importSkip:
+				result.Skipped = append(result.Skipped, item.UUID)
+				continue
+			case owner != u.UUID:
+				// items of other users are never overwritten
+				item.UserUUID = u.UUID
+				result.Unsaved = append(result.Unsaved, unsaved{item, errUUIDConflict})
+				continue
+			}
+		}
+		accepted = append(accepted, item)
+	}
+
+	saved, unsavedItems, err := accepted.save(store, u.UUID)
+	if err != nil {
+		return result, err
+	}
+	result.Saved = saved
+	result.Unsaved = append(result.Unsaved, unsavedItems...)
+	return result, nil
+}
+
+//ImportFile - imports backup file for user with given email from command line
+func ImportFile(path, email, onConflict string) {
+	db.Init(cfg.DBDriver, dbDSN())
+	runMigrations()
+	store := NewSQLStore(db.Default())
+
+	user := NewUser()
+	if user.loadByEmail(store, email); user.UUID == "" {
+		log.Fatal("Unknown user: ", email)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	backup, err := readBackup(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	result, err := user.Import(store, backup.Items, onConflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, u := range result.Unsaved {
+		log.Println("Unsaved:", u.UUID, u.error)
+	}
+	log.Println("Imported", len(result.Saved), "items, skipped", len(result.Skipped), "unsaved", len(result.Unsaved))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+var errInvalidInvite = errors.New("Invalid or expired invite code")
+
+//Invite - code required to register when invites are enabled
+type Invite struct {
+	Code      string    `json:"code"`
+	MaxUses   int       `json:"max_uses"   sql:"max_uses"`
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expires_at" sql:"expires_at"`
+	CreatedAt time.Time `json:"created_at" sql:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" sql:"updated_at"`
+}
+
+//Invites - list of invites
+type Invites []Invite
+
+//invitesRequired - registration requires valid invite code
+var invitesRequired bool
+
+//RequireInvites - sets whether registration requires invite code
+func RequireInvites(required bool) {
+	invitesRequired = required
+}
+
+//newInvite - invite with random code, maxUses and ttl of 0 mean unlimited
+func newInvite(maxUses int, ttl time.Duration) (Invite, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return Invite{}, err
+	}
+	i := Invite{
+		Code:      base32.StdEncoding.EncodeToString(b),
+		MaxUses:   maxUses,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		i.ExpiresAt = i.CreatedAt.Add(ttl)
+	}
+	return i, nil
+}
+
+//valid - invite is not used up and not expired
+func (i Invite) valid(now time.Time) bool {
+	if i.MaxUses > 0 && i.Uses >= i.MaxUses {
+		return false
+	}
+	return i.ExpiresAt.IsZero() || now.Before(i.ExpiresAt)
+}
+
+//checkInvite - verifies invite code without using it
+func checkInvite(store Store, code string) error {
+	if code == "" {
+		return fmt.Errorf("Invite code is required")
+	}
+	i, err := store.InviteByCode(code)
+	if err == errNotFound || (err == nil && !i.valid(time.Now())) {
+		return errInvalidInvite
+	}
+	return err
+}
+
+//inviteCommand - invite create|list|revoke
+func inviteCommand(store Store, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: invite create|list|revoke")
+	}
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("invite create", flag.ExitOnError)
+		uses := fs.Int("uses", 1, "number of registrations allowed with the code, 0 for unlimited")
+		expires := fs.Duration("expires", 0, "time the code is valid for, e.g. 72h, 0 for no expiry")
+		fs.Parse(args[1:])
+		i, err := newInvite(*uses, *expires)
+		if err != nil {
+			return err
+		}
+		if err := store.CreateInvite(&i); err != nil {
+			return err
+		}
+		fmt.Println(i.Code)
+		return nil
+	case "list":
+		fs := flag.NewFlagSet("invite list", flag.ExitOnError)
+		asJSON := fs.Bool("json", false, "print as JSON")
+		fs.Parse(args[1:])
+		invites, err := store.Invites()
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(os.Stdout, invites)
+		}
+		return invites.print(os.Stdout)
+	case "revoke":
+		if len(args) < 2 {
+			return fmt.Errorf("Usage: invite revoke <code>")
+		}
+		if _, err := store.InviteByCode(args[1]); err != nil {
+			return fmt.Errorf("Unknown invite: %s", args[1])
+		}
+		return store.DeleteInvite(args[1])
+	}
+	return fmt.Errorf("Unknown invite command: %s", args[0])
+}
+
+//print - invites as table
+func (invites Invites) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CODE\tUSES\tEXPIRES\tCREATED\tSTATUS")
+	now := time.Now()
+	for _, i := range invites {
+		uses := strconv.Itoa(i.Uses) + "/"
+		if i.MaxUses > 0 {
+			uses += strconv.Itoa(i.MaxUses)
+		} else {
+			uses += "-"
+		}
+		status := "valid"
+		if i.MaxUses > 0 && i.Uses >= i.MaxUses {
+			status = "used"
+		} else if !i.valid(now) {
+			status = "expired"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", i.Code, uses, formatTime(i.ExpiresAt), formatTime(i.CreatedAt), status)
+	}
+	return tw.Flush()
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -12,7 +14,6 @@ import (
 	"github.com/deckarep/golang-set"
 	// "github.com/kisielk/sqlstruct"
 	"github.com/satori/go.uuid"
-	"github.com/tectiv3/standardfile/db"
 )
 
 // Item - is an item type
@@ -24,14 +25,15 @@ type Item struct {
 	EncItemKey  string    `json:"enc_item_key" sql:"enc_item_key"`
 	AuthHash    string    `json:"auth_hash"    sql:"auth_hash"`
 	Deleted     bool      `json:"deleted"`
+	ChangeSeq   int64     `json:"-"          sql:"change_seq"`
 	CreatedAt   time.Time `json:"created_at" sql:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" sql:"updated_at"`
 }
 
 type it interface {
-	create() error
-	update() error
-	delete() error
+	create(w ItemWriter) error
+	update(w ItemWriter) error
+	delete(w ItemWriter) error
 }
 
 //Items - is an items slice
@@ -39,6 +41,7 @@ type Items []Item
 
 //SyncRequest - type for incoming sync request
 type SyncRequest struct {
+	API         string `json:"api"`
 	Items       Items  `json:"items"`
 	SyncToken   string `json:"sync_token"`
 	CursorToken string `json:"cursor_token"`
@@ -50,20 +53,59 @@ type unsaved struct {
 	error
 }
 
+var errUUIDConflict = errors.New(uuidConflict)
+
+//MarshalJSON - unsaved item in the format of legacy sync API
+func (u unsaved) MarshalJSON() ([]byte, error) {
+	e := data{"message": u.error.Error()}
+	if u.error == errUUIDConflict {
+		e["tag"] = uuidConflict
+	}
+	return json.Marshal(data{"item": u.Item, "error": e})
+}
+
+//conflict - item rejected by the server, reported to clients of API 20190520
+type conflict struct {
+	Type        string `json:"type"`
+	ServerItem  *Item  `json:"server_item,omitempty"`
+	UnsavedItem *Item  `json:"unsaved_item,omitempty"`
+}
+
 //SyncResponse - type for response
 type SyncResponse struct {
-	Retrieved   Items     `json:"retrieved_items"`
-	Saved       Items     `json:"saved_items"`
-	Unsaved     []unsaved `json:"unsaved"`
-	SyncToken   string    `json:"sync_token"`
-	CursorToken string    `json:"cursor_token,omitempty"`
+	Retrieved   Items      `json:"retrieved_items"`
+	Saved       Items      `json:"saved_items"`
+	Unsaved     []unsaved  `json:"unsaved"`
+	Conflicts   []conflict `json:"conflicts"`
+	SyncToken   string     `json:"sync_token"`
+	CursorToken string     `json:"cursor_token,omitempty"`
+}
+
+//cursor - position in the user's change sequence. Legacy time based tokens set UpdatedAt and UUID instead
+type cursor struct {
+	Seq       int64
+	UpdatedAt time.Time
+	UUID      string
 }
 
 const minConflictInterval = 20.0
 
+//maxSyncLimit - most items returned by single sync, also used when client sends no limit
+const maxSyncLimit = 100000
+
+//syncAPIConflicts - first sync API version where clients resolve conflicts themselves
+const syncAPIConflicts = "20190520"
+
+const (
+	syncConflict = "sync_conflict"
+	uuidConflict = "uuid_conflict"
+)
+
 //LoadValue - hydrate struct from map
 func (r *SyncRequest) LoadValue(name string, value []string) {
 	switch name {
+	case "api":
+		r.API = value[0]
 	case "items":
 		r.Items = Items{}
 	case "sync_token":
@@ -96,45 +138,63 @@ func (i *Item) LoadValue(name string, value []string) {
 }
 
 //Save - save current item into DB
-func (i *Item) save() error {
-	if i.UUID == "" || !i.Exists() {
-		return i.create()
+func (i *Item) save(w ItemWriter) error {
+	if i.UUID == "" || !i.existsIn(w) {
+		return i.create(w)
 	}
-	return i.update()
+	return i.update(w)
 }
 
-func (i *Item) create() error {
+func (i *Item) create(w ItemWriter) error {
 	if i.UUID == "" {
 		i.UUID = uuid.Must(uuid.NewV4()).String()
 	}
 	i.CreatedAt = time.Now()
 	i.UpdatedAt = time.Now()
 	Log("Create:", i.UUID)
-	return db.Query("INSERT INTO `items` (`uuid`, `user_uuid`, content,  content_type, enc_item_key, auth_hash, deleted, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?,?)", i.UUID, i.UserUUID, i.Content, i.ContentType, i.EncItemKey, i.AuthHash, i.Deleted, i.CreatedAt, i.UpdatedAt)
+	return w.CreateItem(i)
 }
 
-func (i *Item) update() error {
+func (i *Item) update(w ItemWriter) error {
+	current, err := w.ItemByUUID(i.UserUUID, i.UUID)
+	if err != nil {
+		return err
+	}
+	if current.Content != i.Content {
+		if err := keepRevision(w, current); err != nil {
+			return err
+		}
+	}
 	i.UpdatedAt = time.Now()
 	Log("Update:", i.UUID)
-	return db.Query("UPDATE `items` SET `content`=?, `enc_item_key`=?, `auth_hash`=?, `deleted`=?, `updated_at`=? WHERE `uuid`=? AND `user_uuid`=?", i.Content, i.EncItemKey, i.AuthHash, i.Deleted, i.UpdatedAt, i.UUID, i.UserUUID)
+	return w.UpdateItem(i)
 }
 
-func (i *Item) delete() error {
+func (i *Item) delete(w ItemWriter) error {
 	if i.UUID == "" {
 		return fmt.Errorf("Trying to delete unexisting item")
 	}
+	// last content of deleted item stays in its history
+	if current, err := w.ItemByUUID(i.UserUUID, i.UUID); err == nil {
+		if err := keepRevision(w, current); err != nil {
+			return err
+		}
+	} else if err != errNotFound {
+		return err
+	}
 	i.Content = ""
 	i.EncItemKey = ""
 	i.AuthHash = ""
+	i.Deleted = true
 	i.UpdatedAt = time.Now()
 
-	return db.Query("UPDATE `items` SET `content`='', `enc_item_key`='', `auth_hash`='',`deleted`=1, `updated_at`=? WHERE `uuid`=? AND `user_uuid`=?", i.UpdatedAt, i.UUID, i.UserUUID)
+	return w.DeleteItem(i)
 }
 
-func (i Item) copy() (Item, error) {
+func (i Item) copy(store Store) (Item, error) {
 	i.UUID = uuid.Must(uuid.NewV4()).String()
 	i.UpdatedAt = time.Now()
-	err := i.create()
+	err := i.create(store)
 	if err != nil {
 		Log(err)
 		return Item{}, err
@@ -143,38 +203,60 @@ func (i Item) copy() (Item, error) {
 }
 
 //Exists - checks if current user exists in DB
-func (i Item) Exists() bool {
+func (i Item) Exists(store Store) bool {
+	return i.existsIn(store)
+}
+
+func (i Item) existsIn(w ItemWriter) bool {
 	if i.UUID == "" {
 		return false
 	}
-	uuid, err := db.SelectFirst("SELECT `uuid` FROM `items` WHERE `uuid`=?", i.UUID)
+	_, err := w.ItemByUUID(i.UserUUID, i.UUID)
 
 	if err != nil {
 		Log(err)
 		return false
 	}
-	Log("Exists:", uuid)
-	return uuid != ""
+	Log("Exists:", i.UUID)
+	return true
 }
 
-//LoadByUUID - loads item info from DB
-func (i *Item) LoadByUUID(uuid string) bool {
-	_, err := db.SelectStruct("SELECT * FROM `items` WHERE `uuid`=?", i, uuid)
+//LoadByUUID - loads item of the same user from DB
+func (i *Item) LoadByUUID(store Store, uuid string) bool {
+	item, err := store.ItemByUUID(i.UserUUID, uuid)
 
 	if err != nil {
 		Log(err)
 		return false
 	}
 
+	*i = item
 	return true
 }
 
-//GetTokenFromTime - generates sync token for current time
-func GetTokenFromTime(date time.Time) string {
-	return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("1:%d", date.UnixNano())))
+//GetTokenFromSeq - generates sync or cursor token for position in user's change sequence
+func GetTokenFromSeq(seq int64) string {
+	return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("2:%d", seq)))
+}
+
+//GetCursorFromToken - retrieve position in user's change sequence from sync or cursor token
+func GetCursorFromToken(token string) cursor {
+	decoded, _ := base64.URLEncoding.DecodeString(token)
+	parts := strings.SplitN(string(decoded), ":", 3)
+	if parts[0] == "2" && len(parts) == 2 {
+		if seq, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			return cursor{Seq: seq}
+		}
+	}
+	// version 1 tokens were made of item timestamps
+	c := cursor{UpdatedAt: GetTimeFromToken(token)}
+	if len(parts) == 3 {
+		c.UUID = parts[2]
+	}
+	return c
 }
 
-//GetTimeFromToken - retrieve datetime from sync token
+//GetTimeFromToken - retrieve datetime from version 1 sync token
 func GetTimeFromToken(token string) time.Time {
 	decoded, err := base64.URLEncoding.DecodeString(token)
 	if err != nil {
@@ -182,6 +264,10 @@ func GetTimeFromToken(token string) time.Time {
 		return time.Now()
 	}
 	parts := strings.Split(string(decoded), ":")
+	if len(parts) < 2 {
+		Log("Invalid token:", token)
+		return time.Now()
+	}
 	str, err := strconv.ParseUint(parts[1], 10, 64)
 	if err != nil {
 		Log(err)
@@ -191,45 +277,95 @@ func GetTimeFromToken(token string) time.Time {
 }
 
 //SyncItems - sync manager
-func (u User) SyncItems(request SyncRequest) (SyncResponse, error) {
+func (u User) SyncItems(store Store, request SyncRequest) (SyncResponse, error) {
 
 	response := SyncResponse{
 		Retrieved:   Items{},
 		Saved:       Items{},
 		Unsaved:     []unsaved{},
-		SyncToken:   GetTokenFromTime(time.Now()),
+		Conflicts:   []conflict{},
 		CursorToken: "",
 	}
 
-	if request.Limit == 0 {
-		request.Limit = 100000
+	if request.Limit <= 0 || request.Limit > maxSyncLimit {
+		request.Limit = maxSyncLimit
 	}
 	var err error
-	var cursorTime time.Time
+	var position int64
 	Log("Get items")
-	response.Retrieved, cursorTime, err = u.getItems(request)
+	response.Retrieved, position, response.CursorToken, err = u.getItems(store, request)
 	// Log("Retrieved items:", response.Retrieved)
 	if err != nil {
 		return response, err
 	}
-	if !cursorTime.IsZero() {
-		response.CursorToken = GetTokenFromTime(cursorTime)
+	if request.resolvesConflicts() {
+		return u.syncItems(store, request, response, position)
 	}
 	Log("Save incoming items", request)
-	response.Saved, response.Unsaved, err = request.Items.save(u.UUID)
+	response.Saved, response.Unsaved, err = request.Items.save(store, u.UUID)
 	if err != nil {
 		return response, err
 	}
+	response.SyncToken = GetTokenFromSeq(response.Saved.advance(position))
 	if len(response.Saved) > 0 {
-		response.SyncToken = GetTokenFromTime(response.Saved[0].UpdatedAt)
 		// Check for conflicts
 		Log("Conflicts check")
-		response.Saved.checkForConflicts(&response.Retrieved)
+		response.Saved.checkForConflicts(store, &response.Retrieved)
 	}
 	return response, nil
 }
 
-func (items Items) checkForConflicts(existing *Items) {
+//resolvesConflicts - client supports conflicts reporting instead of conflicted copies made by server
+func (r SyncRequest) resolvesConflicts() bool {
+	return r.API >= syncAPIConflicts
+}
+
+//syncItems - saves incoming items reporting conflicts to the client, API 20190520
+func (u User) syncItems(store Store, request SyncRequest, response SyncResponse, position int64) (SyncResponse, error) {
+	var err error
+	Log("Save incoming items checking conflicts", request.Items)
+	response.Saved, response.Unsaved, response.Conflicts, err = request.Items.saveChecked(store, u.UUID)
+	if err != nil {
+		return response, err
+	}
+	response.SyncToken = GetTokenFromSeq(response.Saved.advance(position))
+	// saved items and conflicts already carry the latest server state
+	for _, item := range response.Saved {
+		response.Retrieved = response.Retrieved.without(item.UUID)
+	}
+	for _, c := range response.Conflicts {
+		if c.ServerItem != nil {
+			response.Retrieved = response.Retrieved.without(c.ServerItem.UUID)
+		}
+	}
+	return response, nil
+}
+
+//conflictIn - reports item taken by another user or changed since the client has seen it
+func (i Item) conflictIn(w ItemWriter) (*conflict, error) {
+	incoming := i
+	if i.isOwnedByOther(w, i.UserUUID) {
+		Log("UUID conflict:", i.UUID)
+		return &conflict{Type: uuidConflict, UnsavedItem: &incoming}, nil
+	}
+	if i.UUID == "" {
+		return nil, nil
+	}
+	server, err := w.ItemByUUID(i.UserUUID, i.UUID)
+	if err == errNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if i.isStaleComparedTo(server) {
+		Log("Sync conflict:", i.UUID)
+		return &conflict{Type: syncConflict, ServerItem: &server}, nil
+	}
+	return nil, nil
+}
+
+func (items Items) checkForConflicts(store Store, existing *Items) {
 	Log("Saved len:", len(items))
 	Log("Retrieved len:", len(*existing))
 	saved := mapset.NewSet()
@@ -251,7 +387,7 @@ func (items Items) checkForConflicts(existing *Items) {
 
 		if savedCopy.isConflictedWith(retrievedCopy) {
 			log.Printf("Creating conflicted copy of %v\n", uuid)
-			dupe, err := retrievedCopy.copy()
+			dupe, err := retrievedCopy.copy(store)
 			if err != nil {
 				Log(err)
 			} else {
@@ -262,77 +398,154 @@ func (items Items) checkForConflicts(existing *Items) {
 	}
 }
 
+//isStaleComparedTo - client sends updated_at of the server version it has changed, anything newer was changed elsewhere
+func (i Item) isStaleComparedTo(server Item) bool {
+	serverTime := server.UpdatedAt
+	// js clients send back updated_at with millisecond precision only
+	if i.UpdatedAt.Equal(i.UpdatedAt.Truncate(time.Millisecond)) {
+		serverTime = serverTime.Truncate(time.Millisecond)
+	}
+	return serverTime.After(i.UpdatedAt)
+}
+
 func (i Item) isConflictedWith(copy Item) bool {
 	diff := math.Abs(float64(i.UpdatedAt.Unix() - copy.UpdatedAt.Unix()))
 	Log("Conflict diff, min interval:", diff, minConflictInterval)
 	return diff > minConflictInterval
 }
 
-func (items Items) save(userUUID string) (Items, []unsaved, error) {
+//save - saves items in a single transaction. Items failing validation are reported as unsaved,
+//any other error rolls back the whole batch
+func (items Items) save(store Store, userUUID string) (Items, []unsaved, error) {
+	saved, unsaved, _, err := items.write(store, userUUID, false)
+	return saved, unsaved, err
+}
+
+//saveChecked - save, but items conflicting with the server state are reported as conflicts. They are checked
+//in the same transaction, so nothing can change the item between the check and the save
+func (items Items) saveChecked(store Store, userUUID string) (Items, []unsaved, []conflict, error) {
+	return items.write(store, userUUID, true)
+}
+
+func (items Items) write(store Store, userUUID string, checkConflicts bool) (Items, []unsaved, []conflict, error) {
 	savedItems := Items{}
 	unsavedItems := []unsaved{}
+	conflicts := []conflict{}
 
 	if len(items) == 0 {
-		return savedItems, unsavedItems, nil
+		return savedItems, unsavedItems, conflicts, nil
 	}
 
-	for _, item := range items {
-		var err error
-		item.UserUUID = userUUID
-		if item.Deleted {
-			err = item.delete()
-		} else {
-			err = item.save()
-		}
-		if err != nil {
-			unsavedItems = append(unsavedItems, unsaved{item, err})
-			Log("Unsaved:", item)
-		} else {
-			item.load() //reloading item info from DB
+	err := store.WriteItems(func(w ItemWriter) error {
+		for _, item := range items {
+			item.UserUUID = userUUID
+			if checkConflicts {
+				c, err := item.conflictIn(w)
+				if err != nil {
+					return err
+				}
+				if c != nil {
+					conflicts = append(conflicts, *c)
+					continue
+				}
+			}
+			if err := item.validate(w); err != nil {
+				unsavedItems = append(unsavedItems, unsaved{item, err})
+				Log("Unsaved:", item)
+				continue
+			}
+			var err error
+			if item.Deleted {
+				err = item.delete(w)
+			} else {
+				err = item.save(w)
+			}
+			if err != nil {
+				return err
+			}
+			//reloading item info from DB
+			if !item.load(w) {
+				return fmt.Errorf("Saved item %s can't be loaded", item.UUID)
+			}
 			savedItems = append(savedItems, item)
 			Log("Saved:", item)
 		}
+		return nil
+	})
+	if err != nil {
+		Log("Batch rolled back:", err)
+		return Items{}, []unsaved{}, []conflict{}, err
 	}
-	return savedItems, unsavedItems, nil
+	return savedItems, unsavedItems, conflicts, nil
 }
 
-func (i *Item) load() bool {
-	return i.LoadByUUID(i.UUID)
+//validate - checks if item can be saved for its user
+func (i Item) validate(w ItemWriter) error {
+	if i.isOwnedByOther(w, i.UserUUID) {
+		return errUUIDConflict
+	}
+	// deleting item the user doesn't have would change nothing, it's not reported as saved
+	if i.Deleted && !i.existsIn(w) {
+		return fmt.Errorf("Trying to delete unexisting item")
+	}
+	return nil
 }
 
-func (u User) getItems(request SyncRequest) (items Items, cursorTime time.Time, err error) {
-	if request.CursorToken != "" {
-		Log("loadItemsFromDate")
-		items, err = u.loadItemsFromDate(GetTimeFromToken(request.CursorToken))
-	} else if request.SyncToken != "" {
-		Log("loadItemsOlder")
-		items, err = u.loadItemsOlder(GetTimeFromToken(request.SyncToken))
-	} else {
-		Log("loadItems")
-		items, err = u.loadItems(request.Limit)
-		if len(items) > 0 {
-			cursorTime = items[len(items)-1].UpdatedAt
-		}
+//isOwnedByOther - checks if item uuid is already taken by another user
+func (i Item) isOwnedByOther(w ItemWriter, userUUID string) bool {
+	if i.UUID == "" {
+		return false
+	}
+	owner, err := w.ItemOwner(i.UUID)
+	return err == nil && owner != userUUID
+}
+
+func (i *Item) load(w ItemWriter) bool {
+	item, err := w.ItemByUUID(i.UserUUID, i.UUID)
+	if err != nil {
+		Log(err)
+		return false
 	}
-	return items, cursorTime, err
+	*i = item
+	return true
 }
 
-func (u User) loadItemsFromDate(date time.Time) ([]Item, error) {
-	items := []Item{}
-	err := db.Select("SELECT * FROM `items` WHERE `user_uuid`=? AND `updated_at` >= ? ORDER BY `updated_at` DESC", &items, u.UUID, date)
-	return items, err
+//getItems returns a page of changed items, position in the change sequence the client is synced up to
+//and cursor token pointing to the next page
+func (u User) getItems(store Store, request SyncRequest) (items Items, position int64, cursorToken string, err error) {
+	since := cursor{}
+	if request.CursorToken != "" {
+		since = GetCursorFromToken(request.CursorToken)
+	} else if request.SyncToken != "" {
+		since = GetCursorFromToken(request.SyncToken)
+	}
+	// changes up to the latest committed one are either returned below or already known to the client
+	if position, err = store.ChangeSeq(u.UUID); err != nil {
+		return items, 0, "", err
+	}
+	Log("loadItems since", since)
+	// load one extra item to find out if there is a next page
+	items, err = u.loadItemsSince(store, since, request.Limit+1)
+	if err != nil {
+		return items, 0, "", err
+	}
+	if len(items) > request.Limit {
+		items = items[:request.Limit]
+		position = items[len(items)-1].ChangeSeq
+		return items, position, GetTokenFromSeq(position), nil
+	}
+	if len(items) > 0 && items[len(items)-1].ChangeSeq > position {
+		position = items[len(items)-1].ChangeSeq
+	}
+	return items, position, "", nil
 }
 
-func (u User) loadItemsOlder(date time.Time) ([]Item, error) {
-	items := []Item{}
-	err := db.Select("SELECT * FROM `items` WHERE `user_uuid`=? AND `updated_at` > ? ORDER BY `updated_at` DESC", &items, u.UUID, date)
-	return items, err
+func (u User) loadItemsSince(store Store, since cursor, limit int) (Items, error) {
+	return store.ItemsChangedSince(u.UUID, since, limit)
 }
 
-func (u User) loadItems(limit int) ([]Item, error) {
-	items := []Item{}
-	err := db.Select("SELECT * FROM `items` WHERE `user_uuid`=? ORDER BY `updated_at` DESC", &items, u.UUID)
-	return items, err
+func (u User) loadItems(store Store, limit int) (Items, error) {
+	return u.loadItemsSince(store, cursor{}, limit)
 }
 
 func (items Items) find(uuid string) Item {
@@ -344,6 +557,28 @@ func (items Items) find(uuid string) Item {
 	return Item{}
 }
 
+//advance - moves sync position past saved items, unless changes of other clients were interleaved with them
+func (items Items) advance(position int64) int64 {
+	for _, item := range items {
+		if item.ChangeSeq != position+1 {
+			break
+		}
+		position = item.ChangeSeq
+	}
+	return position
+}
+
+//without - returns items except the one with given uuid
+func (items Items) without(uuid string) Items {
+	result := Items{}
+	for _, item := range items {
+		if item.UUID != uuid {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
 func (items *Items) delete(uuid string) {
 	position := 0
 	for i, item := range *items {
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//publicKey - secret shipped with older versions, tokens signed with it can be forged by anyone
+const publicKey = "qA6irmDikU6RkCM4V0cJiUJEROuCsqTa1esexI4aWedSv405v8lw4g1KB1nQVsSdCrcyRlKFdws4XPlsArWwv9y5Xr5Jtkb11w1NxKZabOUa7mxjeENuCs31Y1Ce49XH9kGMPe0ms7iV7e9F6WgnsPFGOlIA3CwfGyr12okas2EsDd71SbSnA0zJYjyxeCVCZJWISmLB"
+
+//envKeyID - kid of the key given by SECRET_KEY_BASE
+const envKeyID = "env"
+
+//signingKey - JWT signing key identified by kid
+type signingKey struct {
+	ID        string    `json:"id"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+//keyFile - signing keys persisted in key_file. Tokens are signed with the current key
+//and accepted with any of the keys, so keys can be rotated without signing everyone out
+type keyFile struct {
+	Current string       `json:"current"`
+	Keys    []signingKey `json:"keys"`
+	// DataKey encrypts secrets stored in the database, it's not rotated with signing keys
+	DataKey string `json:"data_key"`
+}
+
+//keyring - keys used by the server
+type keyring struct {
+	sync.RWMutex
+	current string
+	keys    map[string][]byte
+	data    []byte
+}
+
+var keys = &keyring{}
+
+var errNoKeys = errors.New("Signing keys are not loaded")
+
+//LoadKeys - loads keys from key file and SECRET_KEY_BASE, key file with new key is created when there are none
+func LoadKeys(path string) error {
+	k, err := readKeys(path, os.Getenv("SECRET_KEY_BASE"))
+	if err != nil {
+		return err
+	}
+	keys = k
+	return nil
+}
+
+func readKeys(path, envKey string) (*keyring, error) {
+	if envKey == publicKey {
+		return nil, fmt.Errorf("SECRET_KEY_BASE is set to the default key published with the source code, set it to a random secret or unset it to use generated key file")
+	}
+	f, err := readKeyFile(path)
+	if os.IsNotExist(err) && envKey == "" {
+		log.Println("Generating signing key in", path)
+		f = keyFile{}
+		if err = f.rotate(); err == nil {
+			err = f.save(path)
+		}
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{current: f.Current, keys: map[string][]byte{}}
+	for _, key := range f.Keys {
+		secret, err := base64.StdEncoding.DecodeString(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %s: %v", key.ID, err)
+		}
+		k.keys[key.ID] = secret
+	}
+	if f.DataKey != "" {
+		if k.data, err = base64.StdEncoding.DecodeString(f.DataKey); err != nil {
+			return nil, fmt.Errorf("Invalid data key: %v", err)
+		}
+	}
+	if envKey != "" {
+		k.keys[envKeyID] = []byte(envKey)
+		if k.current == "" {
+			k.current = envKeyID
+		}
+		if k.data == nil {
+			k.data = envDataKey(envKey)
+		}
+	}
+	if _, ok := k.keys[k.current]; !ok {
+		return nil, fmt.Errorf("Current signing key %q is missing in %s", k.current, path)
+	}
+	if len(k.data) != 32 {
+		return nil, fmt.Errorf("Data key is missing in %s", path)
+	}
+	return k, nil
+}
+
+//envDataKey - data key of installs configured with SECRET_KEY_BASE only
+func envDataKey(envKey string) []byte {
+	sum := sha256.Sum256([]byte("standardfile data key:" + envKey))
+	return sum[:]
+}
+
+//legacyDataKey - data key of versions before key file, installs without SECRET_KEY_BASE derived it from publicKey
+func legacyDataKey() []byte {
+	return envDataKey(publicKey)
+}
+
+func readKeyFile(path string) (keyFile, error) {
+	f := keyFile{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(content, &f); err != nil {
+		return f, fmt.Errorf("Invalid key file %s: %v", path, err)
+	}
+	return f, nil
+}
+
+//save - writes key file readable by owner only
+func (f keyFile) save(path string) error {
+	content, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//rotate - adds new random key and makes it current, data key is generated if missing
+func (f *keyFile) rotate() error {
+	secret, err := randomBytes(64)
+	if err != nil {
+		return err
+	}
+	id, err := randomBytes(4)
+	if err != nil {
+		return err
+	}
+	key := signingKey{ID: hex.EncodeToString(id), Secret: base64.StdEncoding.EncodeToString(secret), CreatedAt: time.Now()}
+	f.Keys = append(f.Keys, key)
+	f.Current = key.ID
+	if f.DataKey == "" {
+		data, err := randomBytes(32)
+		if err != nil {
+			return err
+		}
+		f.DataKey = base64.StdEncoding.EncodeToString(data)
+	}
+	return nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+//sign - signs token with the current key
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	k.RLock()
+	defer k.RUnlock()
+	if k.keys == nil {
+		return "", errNoKeys
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if k.current != envKeyID {
+		token.Header["kid"] = k.current
+	}
+	return token.SignedString(k.keys[k.current])
+}
+
+//verificationKey - jwt.Keyfunc looking up key by kid, tokens without kid were signed with SECRET_KEY_BASE
+func (k *keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	k.RLock()
+	defer k.RUnlock()
+	if k.keys == nil {
+		return nil, errNoKeys
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = envKeyID
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key")
+	}
+	return key, nil
+}
+
+//dataKey - key encrypting secrets stored in the database
+func (k *keyring) dataKey() ([]byte, error) {
+	k.RLock()
+	defer k.RUnlock()
+	if k.data == nil {
+		return nil, errNoKeys
+	}
+	return k.data, nil
+}
+
+//keyCommand - key list|rotate|remove, changes take effect after restart
+func keyCommand(store Store, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: key list|rotate|remove")
+	}
+	f, err := readKeyFile(cfg.KeyFile)
+	if err != nil && !(os.IsNotExist(err) && args[0] == "rotate") {
+		return err
+	}
+	switch args[0] {
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCREATED\tCURRENT")
+		for _, key := range f.Keys {
+			fmt.Fprintf(tw, "%s\t%s\t%t\n", key.ID, formatTime(key.CreatedAt), key.ID == f.Current)
+		}
+		return tw.Flush()
+	case "rotate":
+		// secrets encrypted with key derived from SECRET_KEY_BASE stay readable
+		if env := os.Getenv("SECRET_KEY_BASE"); f.DataKey == "" && env != "" && env != publicKey {
+			f.DataKey = base64.StdEncoding.EncodeToString(envDataKey(env))
+		}
+		if err := f.rotate(); err != nil {
+			return err
+		}
+		if err := f.save(cfg.KeyFile); err != nil {
+			return err
+		}
+		log.Println("New signing key", f.Current, "is used after restart, remove the previous one once issued tokens expire")
+		return nil
+	case "remove":
+		if len(args) < 2 {
+			return fmt.Errorf("Usage: key remove <id>")
+		}
+		if args[1] == f.Current {
+			return fmt.Errorf("Current key can't be removed, rotate it first")
+		}
+		for i, key := range f.Keys {
+			if key.ID == args[1] {
+				f.Keys = append(f.Keys[:i], f.Keys[i+1:]...)
+				return f.save(cfg.KeyFile)
+			}
+		}
+		return fmt.Errorf("Unknown key: %s", args[1])
+	}
+	return fmt.Errorf("Unknown key command: %s", args[0])
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	emailAttempts  = 5
+	ipAttempts     = 50
+	lockoutBase    = time.Minute
+	lockoutMax     = time.Hour
+	attemptsWindow = 24 * time.Hour
+	lockedTag      = "too-many-attempts"
+	// maxAttempts bounds memory used by tracked emails and IPs
+	maxAttempts = 100000
+)
+
+//lockoutError - sign in is locked after too many failed attempts
+type lockoutError struct {
+	until time.Time
+}
+
+func (e lockoutError) Error() string {
+	return "Too many successive login requests. Please try your request again later."
+}
+
+//retryAfter - seconds until sign in is allowed again
+func (e lockoutError) retryAfter() int {
+	return int(time.Until(e.until)/time.Second) + 1
+}
+
+//attempt - failed sign ins by one email or IP
+type attempt struct {
+	key      string
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+//attempts - tracks failed sign ins per email and per IP in memory.
+//Entries are kept in lists by last failure, most recent in front, so the oldest are expired and evicted first.
+//Entries which reached their limit move to locked list and are evicted only when there is nothing else left
+type attempts struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	failing *list.List
+	locked  *list.List
+}
+
+var loginAttempts = newAttempts()
+
+func newAttempts() *attempts {
+	return &attempts{entries: map[string]*list.Element{}, failing: list.New(), locked: list.New()}
+}
+
+func emailKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+//check - returns lockoutError if email or IP is locked
+func (a *attempts) check(email, ip string) error {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	for _, key := range []string{emailKey(email), ipKey(ip)} {
+		if el, ok := a.entries[key]; ok && el.Value.(*attempt).until.After(now) {
+			return lockoutError{el.Value.(*attempt).until}
+		}
+	}
+	return nil
+}
+
+//failed - records failed sign in, locking email or IP once their limit is reached.
+//Each failure past the limit doubles the lockout up to lockoutMax
+func (a *attempts) failed(email, ip string) error {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	a.expire(now)
+	var err error
+	for key, limit := range map[string]int{emailKey(email): emailAttempts, ipKey(ip): ipAttempts} {
+		el, ok := a.entries[key]
+		if !ok {
+			if len(a.entries) >= maxAttempts {
+				a.evict()
+			}
+			el = a.failing.PushFront(&attempt{key: key})
+			a.entries[key] = el
+		}
+		e := el.Value.(*attempt)
+		e.failures++
+		e.last = now
+		if e.failures < limit {
+			a.failing.MoveToFront(el)
+			continue
+		}
+		if e.until.IsZero() {
+			a.failing.Remove(el)
+			a.entries[key] = a.locked.PushFront(e)
+		} else {
+			a.locked.MoveToFront(el)
+		}
+		lockout := lockoutBase << uint(e.failures-limit)
+		if lockout > lockoutMax || lockout <= 0 {
+			lockout = lockoutMax
+		}
+		e.until = now.Add(lockout)
+		Log(fmt.Sprintf("Sign in locked for %s until %s", key, e.until.Format(time.RFC3339)))
+		if err == nil || e.until.After(err.(lockoutError).until) {
+			err = lockoutError{e.until}
+		}
+	}
+	return err
+}
+
+//succeeded - forgets failures of the email. IP failures are kept, so attacker can't reset them with own account
+func (a *attempts) succeeded(email string) {
+	a.Lock()
+	defer a.Unlock()
+	if el, ok := a.entries[emailKey(email)]; ok {
+		a.remove(el)
+	}
+}
+
+//expire - forgets failures older than attemptsWindow. Lockouts are shorter than the window,
+//so the oldest entries of both lists are never locked
+func (a *attempts) expire(now time.Time) {
+	for _, l := range []*list.List{a.failing, a.locked} {
+		for el := l.Back(); el != nil && now.Sub(el.Value.(*attempt).last) > attemptsWindow; el = l.Back() {
+			a.remove(el)
+		}
+	}
+}
+
+//evict - makes room for new entry by forgetting the one that failed longest ago, locked ones are kept if possible
+func (a *attempts) evict() {
+	if el := a.failing.Back(); el != nil {
+		a.remove(el)
+	} else if el := a.locked.Back(); el != nil {
+		a.remove(el)
+	}
+}
+
+func (a *attempts) remove(el *list.Element) {
+	e := el.Value.(*attempt)
+	if e.until.IsZero() {
+		a.failing.Remove(el)
+	} else {
+		a.locked.Remove(el)
+	}
+	delete(a.entries, e.key)
+}
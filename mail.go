@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+//Mailer - SMTP server notifications are sent through
+type Mailer struct {
+	Host string
+	Port int
+	// TLS is "starttls" (default), "tls" for TLS from the start of connection (usually port 465) or "none"
+	TLS      string
+	Username string
+	Password string
+	From     string
+	// Templates is directory with <name>.txt files replacing built-in templates
+	Templates string
+}
+
+var mailer *Mailer
+
+//UseMailer - sets mailer used for notifications, nil disables email
+func UseMailer(m *Mailer) {
+	mailer = m
+}
+
+//startMailer - turns email on when smtp_host is configured and schedules backup emails
+func startMailer(store Store) error {
+	if cfg.SMTPHost == "" {
+		return nil
+	}
+	switch cfg.SMTPTLS {
+	case "starttls", "tls", "none":
+	default:
+		return fmt.Errorf("Invalid smtp_tls: %q, use starttls, tls or none", cfg.SMTPTLS)
+	}
+	if _, err := mail.ParseAddress(cfg.MailFrom); err != nil {
+		return fmt.Errorf("Invalid mail_from %q: %v", cfg.MailFrom, err)
+	}
+	schedule, err := parseBackupSchedule(cfg.MailAt)
+	if err != nil {
+		return err
+	}
+	UseMailer(&Mailer{
+		Host:      cfg.SMTPHost,
+		Port:      cfg.SMTPPort,
+		TLS:       cfg.SMTPTLS,
+		Username:  cfg.SMTPUsername,
+		Password:  cfg.SMTPPassword,
+		From:      cfg.MailFrom,
+		Templates: cfg.MailTemplates,
+	})
+	log.Println("Sending email through", cfg.SMTPHost)
+	go runScheduled(schedule, "backup emails", func(now time.Time) error {
+		return SendBackupEmails(store, now)
+	})
+	return nil
+}
+
+//mailTemplates - built-in messages, first line is the subject
+var mailTemplates = map[string]string{
+	"sign_in": `Subject: New sign in to your notes account
+
+Hello {{.Email}},
+
+your account was just signed in from a new device:
+
+    Device: {{.Device}}
+    IP address: {{.IP}}
+    Time: {{.Time}}
+
+If this was you, there's nothing to do. Otherwise change your password right away
+and sign out other sessions in the account settings of your app.
+`,
+	"backup": `Subject: Your notes backup for {{.Date}}
+
+Hello {{.Email}},
+
+attached is the encrypted backup of your notes. It can be imported in the Standard Notes app
+with your account password.
+
+You can turn these emails off in the settings of your account.
+`,
+}
+
+//mailAttachment - file attached to the message
+type mailAttachment struct {
+	name    string
+	content []byte
+}
+
+//Send - renders template with values and sends it to the address
+func (m *Mailer) Send(to, name string, values interface{}, attachments ...mailAttachment) error {
+	subject, body, err := m.render(name, values)
+	if err != nil {
+		return err
+	}
+	msg, err := m.message(to, subject, body, attachments)
+	if err != nil {
+		return err
+	}
+	return m.deliver(to, msg)
+}
+
+//render - executes template, which is read from Templates directory if it's there
+func (m *Mailer) render(name string, values interface{}) (subject, body string, err error) {
+	text := mailTemplates[name]
+	if m.Templates != "" {
+		content, err := ioutil.ReadFile(filepath.Join(m.Templates, name+".txt"))
+		if err == nil {
+			text = string(content)
+		} else if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, values); err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(b.String(), "\n", 2)
+	if !strings.HasPrefix(parts[0], "Subject:") || len(parts) < 2 {
+		return "", "", fmt.Errorf("Template %s must start with Subject: line", name)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(parts[0], "Subject:")), strings.TrimLeft(parts[1], "\n"), nil
+}
+
+//message - plain text message, multipart when there are attachments
+func (m *Mailer) message(to, subject, body string, attachments []mailAttachment) ([]byte, error) {
+	var b bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+	header("From", m.From)
+	header("To", to)
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+uuid.Must(uuid.NewV4()).String()+"@"+m.Host+">")
+	header("MIME-Version", "1.0")
+
+	text := textproto.MIMEHeader{}
+	text.Set("Content-Type", "text/plain; charset=utf-8")
+	text.Set("Content-Transfer-Encoding", "quoted-printable")
+	if len(attachments) == 0 {
+		for name := range text {
+			header(name, text.Get(name))
+		}
+		b.WriteString("\r\n")
+		if err := writeQuotedPrintable(&b, body); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	w := multipart.NewWriter(&b)
+	header("Content-Type", "multipart/mixed; boundary="+w.Boundary())
+	b.WriteString("\r\n")
+	part, err := w.CreatePart(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(part, body); err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", mime.TypeByExtension(filepath.Ext(a.name)))
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", "application/octet-stream")
+		}
+		h.Set("Content-Transfer-Encoding", "base64")
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.name}))
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(a.content)
+		// lines of the message are limited to 998 characters
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+//writeQuotedPrintable - encodes text, line breaks are written as CRLF
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+//deliver - sends message over SMTP, authenticating when username is set
+func (m *Mailer) deliver(to string, msg []byte) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("Invalid sender %q: %v", m.From, err)
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	var conn net.Conn
+	if m.TLS == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: m.Host})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if m.TLS == "" || m.TLS == "starttls" {
+		if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+//SendBackupEmails - mails encrypted backup file to every active user who turned email backups on
+func SendBackupEmails(store Store, now time.Time) error {
+	m := mailer
+	if m == nil {
+		return nil
+	}
+	users, err := store.Users()
+	if err != nil {
+		return err
+	}
+	var failed error
+	for _, u := range users {
+		if u.Disabled {
+			continue
+		}
+		if err := m.sendBackup(store, u, now); err != nil {
+			log.Println("Backup email to", u.Email, "failed:", err)
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+	return failed
+}
+
+func (m *Mailer) sendBackup(store Store, u User, now time.Time) error {
+	settings, err := u.GetSettings(store)
+	if err != nil || !settings.EmailBackups {
+		return err
+	}
+	var backup bytes.Buffer
+	if err := u.WriteBackup(store, &backup, itemFilter{}); err != nil {
+		return err
+	}
+	date := now.Format(backupDate)
+	return m.Send(u.Email, "backup", data{"Email": u.Email, "Date": date}, mailAttachment{"Standard Notes Backup - " + date + ".txt", backup.Bytes()})
+}
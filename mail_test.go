@@ -0,0 +1,166 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	sf "github.com/tectiv3/standardfile"
+)
+
+//smtpSink - SMTP server accepting every message
+type smtpSink struct {
+	listener net.Listener
+	messages chan *mail.Message
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{l, make(chan *mail.Message, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 sink ready")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 sink")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			content, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			if msg, err := mail.ReadMessage(bytes.NewReader(content)); err == nil {
+				s.messages <- msg
+			}
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+//next - message delivered within timeout, nil if there is none
+func (s *smtpSink) next(timeout time.Duration) *mail.Message {
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func signInFrom(t *testing.T, srv *sf.Server, userAgent string) {
+	r := httptest.NewRequest("POST", "/api/auth/sign_in", strings.NewReader(`{"email":"mem@local","password":"secret"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("User-Agent", userAgent)
+	w := httptest.NewRecorder()
+	srv.Login(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatal("Sign in failed:", w.Code, w.Body.String())
+	}
+}
+
+func TestMailNotifications(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.listener.Close()
+	port := sink.listener.Addr().(*net.TCPAddr).Port
+	sf.UseMailer(&sf.Mailer{Host: "127.0.0.1", Port: port, TLS: "none", From: "Notes <notes@local>"})
+	defer sf.UseMailer(nil)
+
+	store := sf.NewMemoryStore()
+	srv := sf.NewServer(store)
+	token := registerUser(t, srv, "mem@local")
+	firefox := "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:109.0) Gecko/20100101 Firefox/115.0"
+	signInFrom(t, srv, firefox)
+	msg := sink.next(5 * time.Second)
+	if msg == nil {
+		t.Fatal("Sign in from new device should be mailed")
+	}
+	body, _ := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if msg.Header.Get("To") != "mem@local" || !strings.Contains(msg.Header.Get("Subject"), "New sign in") || !strings.Contains(string(body), "Firefox on macOS") {
+		t.Error("Unexpected sign in alert:", msg.Header, string(body))
+	}
+	signInFrom(t, srv, firefox)
+	if msg := sink.next(300 * time.Millisecond); msg != nil {
+		t.Error("Sign in from known device should not be mailed:", msg.Header)
+	}
+
+	code, res := request(t, srv.UpdateSettings, "POST", "/api/settings", token, `{"sign_in_alerts":false,"email_backups":true}`)
+	if code != http.StatusOK || res["sign_in_alerts"] != false || res["email_backups"] != true {
+		t.Fatal("Updating settings failed:", code, res)
+	}
+	signInFrom(t, srv, "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36")
+	if msg := sink.next(300 * time.Millisecond); msg != nil {
+		t.Error("Sign in alerts should be off:", msg.Header)
+	}
+	if _, res := request(t, srv.ShowSettings, "GET", "/api/settings", token, ""); res["email_backups"] != true {
+		t.Error("Settings should be saved:", res)
+	}
+
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-1","content":"001abc","content_type":"Note"}]}`)
+	registerUser(t, srv, "other@local")
+	if err := sf.SendBackupEmails(store, time.Date(2026, 3, 1, 4, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal("Backup emails failed:", err)
+	}
+	msg = sink.next(5 * time.Second)
+	if msg == nil {
+		t.Fatal("Backup should be mailed")
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" || msg.Header.Get("To") != "mem@local" {
+		t.Fatal("Unexpected backup email:", msg.Header)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	parts.NextPart()
+	attachment, err := parts.NextPart()
+	if err != nil || attachment.FileName() != "Standard Notes Backup - 2026-03-01.txt" {
+		t.Fatal("Backup should be attached:", err)
+	}
+	encoded, _ := ioutil.ReadAll(attachment)
+	content, _ := base64.StdEncoding.DecodeString(strings.Replace(string(encoded), "\r\n", "", -1))
+	backup := struct {
+		Items []sf.Item `json:"items"`
+	}{}
+	if err := json.Unmarshal(content, &backup); err != nil || len(backup.Items) != 1 {
+		t.Error("Unexpected backup:", string(content), err)
+	}
+	if msg := sink.next(300 * time.Millisecond); msg != nil {
+		t.Error("Backups should be mailed only to users who turned them on:", msg.Header)
+	}
+}
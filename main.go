@@ -23,21 +23,67 @@ import (
 
 type config struct {
 	DB         string `config:"db"`
+	DBDriver   string `config:"db_driver" json:"db_driver" yaml:"db_driver" toml:"db_driver"`
+	DBDSN      string `config:"db_dsn" json:"db_dsn" yaml:"db_dsn" toml:"db_dsn"`
 	Port       int    `config:"port"`
 	Socket     string `config:"socket"`
 	NoReg      bool   `config:"noreg"`
 	Debug      bool   `config:"debug"`
 	Foreground bool   `config:"foreground"`
 	UseCORS    bool   `config:"cors" json:"cors" yaml:"cors" toml:"cors"`
+	Revisions  string `config:"revisions"`
+	AccessTTL  string `config:"access_token_ttl" json:"access_token_ttl" yaml:"access_token_ttl" toml:"access_token_ttl"`
+	RefreshTTL string `config:"refresh_token_ttl" json:"refresh_token_ttl" yaml:"refresh_token_ttl" toml:"refresh_token_ttl"`
+	IdleTTL    string `config:"legacy_idle_ttl" json:"legacy_idle_ttl" yaml:"legacy_idle_ttl" toml:"legacy_idle_ttl"`
+	Invites    bool   `config:"invites"`
+	KeyFile    string `config:"key_file" json:"key_file" yaml:"key_file" toml:"key_file"`
+	AdminToken string `config:"admin_token" json:"admin_token" yaml:"admin_token" toml:"admin_token"`
+	Proxies    string `config:"trusted_proxies" json:"trusted_proxies" yaml:"trusted_proxies" toml:"trusted_proxies"`
+	BackupDir  string `config:"backup_dir" json:"backup_dir" yaml:"backup_dir" toml:"backup_dir"`
+	BackupAt   string `config:"backup_schedule" json:"backup_schedule" yaml:"backup_schedule" toml:"backup_schedule"`
+	BackupKeep string `config:"backup_keep" json:"backup_keep" yaml:"backup_keep" toml:"backup_keep"`
+
+	// S3 compatible storage, used for backups instead of backup_dir when bucket is set
+	S3Endpoint  string `config:"s3_endpoint" json:"s3_endpoint" yaml:"s3_endpoint" toml:"s3_endpoint"`
+	S3Region    string `config:"s3_region" json:"s3_region" yaml:"s3_region" toml:"s3_region"`
+	S3Bucket    string `config:"s3_bucket" json:"s3_bucket" yaml:"s3_bucket" toml:"s3_bucket"`
+	S3Prefix    string `config:"s3_prefix" json:"s3_prefix" yaml:"s3_prefix" toml:"s3_prefix"`
+	S3AccessKey string `config:"s3_access_key" json:"s3_access_key" yaml:"s3_access_key" toml:"s3_access_key"`
+	S3SecretKey string `config:"s3_secret_key" json:"s3_secret_key" yaml:"s3_secret_key" toml:"s3_secret_key"`
+	S3PartSize  int    `config:"s3_part_size" json:"s3_part_size" yaml:"s3_part_size" toml:"s3_part_size"`
+
+	// SMTP server for sign in alerts and backup emails, email is off without host
+	SMTPHost      string `config:"smtp_host" json:"smtp_host" yaml:"smtp_host" toml:"smtp_host"`
+	SMTPPort      int    `config:"smtp_port" json:"smtp_port" yaml:"smtp_port" toml:"smtp_port"`
+	SMTPTLS       string `config:"smtp_tls" json:"smtp_tls" yaml:"smtp_tls" toml:"smtp_tls"`
+	SMTPUsername  string `config:"smtp_username" json:"smtp_username" yaml:"smtp_username" toml:"smtp_username"`
+	SMTPPassword  string `config:"smtp_password" json:"smtp_password" yaml:"smtp_password" toml:"smtp_password"`
+	MailFrom      string `config:"mail_from" json:"mail_from" yaml:"mail_from" toml:"mail_from"`
+	MailTemplates string `config:"mail_templates" json:"mail_templates" yaml:"mail_templates" toml:"mail_templates"`
+	MailAt        string `config:"mail_backup_schedule" json:"mail_backup_schedule" yaml:"mail_backup_schedule" toml:"mail_backup_schedule"`
 }
 
 var cfg = config{
 	DB:         "sf.db",
+	DBDriver:   "sqlite3",
 	Port:       8888,
 	Debug:      false,
 	NoReg:      false,
 	Foreground: false,
 	UseCORS:    false,
+	Revisions:  "Note:30",
+	AccessTTL:  "1h",
+	RefreshTTL: "1440h",
+	IdleTTL:    "720h",
+	KeyFile:    "keys.json",
+	Proxies:    "127.0.0.1,::1",
+	BackupAt:   "nightly 03:00",
+	BackupKeep: "daily:7,weekly:4",
+	S3Region:   "us-east-1",
+	S3PartSize: 8,
+	SMTPPort:   587,
+	SMTPTLS:    "starttls",
+	MailAt:     "nightly 04:00",
 }
 
 var (
@@ -45,6 +91,12 @@ var (
 	migrate = flag.Bool("migrate", false, `perform DB migrations`)
 	ver     = flag.Bool("v", false, `show version`)
 	cfgPath = flag.String("c", ".", `config file location`)
+	imp     = flag.String("import", "", `import items from backup file, requires -user`)
+	impUser = flag.String("user", "", `email of the user to import items for`)
+	impMode = flag.String("on_conflict", "skip", `what to do with imported items with existing uuid: skip, overwrite or duplicate (unencrypted items only)`)
+	delUser = flag.String("delete-user", "", `delete the user with given email and all their data`)
+	noMFA   = flag.String("reset-mfa", "", `disable two-factor authentication of the user with given email`)
+	snap    = flag.String("snapshot", "", `write consistent copy of sqlite database to given path, safe while the server runs`)
 	run     = make(chan bool)
 )
 
@@ -56,7 +108,7 @@ var Version = "dev"
 // BuildTime string will be set by linker
 var BuildTime = "N/A"
 
-func init() {
+func loadConfig() {
 	confBackends := []backend.Backend{}
 	cfgPath = getConfigFlag()
 
@@ -93,6 +145,7 @@ func init() {
 }
 
 func main() {
+	loadConfig()
 	flag.Parse()
 
 	if *ver {
@@ -106,11 +159,19 @@ func main() {
         OS/Arch:           ` + runtime.GOOS + "/" + runtime.GOARCH + `
         Loaded Config:     ` + loadedConfig + `
         No Registrations:  ` + strconv.FormatBool(cfg.NoReg) + `
+        Invites Required:  ` + strconv.FormatBool(cfg.Invites) + `
         CORS Enabled:      ` + strconv.FormatBool(cfg.UseCORS) + `
         Run in Foreground: ` + strconv.FormatBool(cfg.Foreground) + `
         Webserver Port:    ` + strconv.Itoa(cfg.Port) + `
         Socket:            ` + socket + `
+        DB Driver:         ` + cfg.DBDriver + `
         DB Path:           ` + cfg.DB + `
+        Key File:          ` + cfg.KeyFile + `
+        Revisions:         ` + cfg.Revisions + `
+        Backup Dir:        ` + cfg.BackupDir + `
+        Backup Bucket:     ` + cfg.S3Bucket + `
+        SMTP Host:         ` + cfg.SMTPHost + `
+        Backup Schedule:   ` + cfg.BackupAt + `
         Debug:             ` + strconv.FormatBool(cfg.Debug))
 		return
 	}
@@ -120,6 +181,34 @@ func main() {
 		return
 	}
 
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
+	}
+
+	if *delUser != "" {
+		PurgeUser(*delUser)
+		return
+	}
+
+	if *noMFA != "" {
+		ResetMFA(*noMFA)
+		return
+	}
+
+	if *snap != "" {
+		SnapshotDB(*snap)
+		return
+	}
+
+	if *imp != "" {
+		if *impUser == "" {
+			log.Fatal("Import requires -user")
+		}
+		ImportFile(*imp, *impUser, *impMode)
+		return
+	}
+
 	if cfg.Port == 0 {
 		cfg.Port = 8888
 	}
@@ -167,6 +256,14 @@ func main() {
 	}
 }
 
+//dbDSN returns data source name for the configured driver
+func dbDSN() string {
+	if cfg.DBDSN != "" {
+		return cfg.DBDSN
+	}
+	return cfg.DB
+}
+
 func termHandler(sig os.Signal) error {
 	close(run)
 	return daemon.ErrStop
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/tectiv3/standardfile/db"
+)
+
+const (
+	totpStep       = 30 * time.Second
+	totpDigits     = 6
+	recoveryCodes  = 10
+	mfaIssuer      = "StandardFile"
+	mfaRequiredTag = "mfa-required"
+	mfaInvalidTag  = "mfa-invalid"
+)
+
+//MFA - TOTP second factor of the user
+type MFA struct {
+	UUID          string    `json:"uuid"`
+	UserUUID      string    `json:"-"          sql:"user_uuid"`
+	Secret        string    `json:"-"          sql:"secret"`
+	RecoveryCodes string    `json:"-"          sql:"recovery_codes"`
+	Enabled       bool      `json:"enabled"`
+	LastStep      int64     `json:"-"          sql:"last_step"`
+	CreatedAt     time.Time `json:"created_at" sql:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at" sql:"updated_at"`
+}
+
+//mfaError - sign in requires valid second factor, reported to clients with tag and key of the code parameter
+type mfaError struct {
+	tag string
+	key string
+}
+
+func (e mfaError) Error() string {
+	if e.tag == mfaRequiredTag {
+		return "Please enter your two-factor authentication code."
+	}
+	return "The two-factor authentication code you entered is incorrect. Please try again."
+}
+
+//paramName - name of sign in parameter carrying the code
+func (m MFA) paramName() string {
+	return "mfa_" + m.UUID
+}
+
+//StartMFA - generates new TOTP secret, which is enabled once the user confirms a code
+func (u User) StartMFA(store Store) (MFA, string, error) {
+	if m, err := store.MFAByUser(u.UUID); err == nil && m.Enabled {
+		return MFA{}, "", fmt.Errorf("Two-factor authentication is already enabled")
+	}
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return MFA{}, "", err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	encrypted, err := encrypt(secret)
+	if err != nil {
+		return MFA{}, "", err
+	}
+	m := MFA{
+		UUID:      uuid.Must(uuid.NewV4()).String(),
+		UserUUID:  u.UUID,
+		Secret:    encrypted,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := store.DeleteMFA(u.UUID); err != nil {
+		return MFA{}, "", err
+	}
+	if err := store.CreateMFA(&m); err != nil {
+		return MFA{}, "", err
+	}
+	return m, secret, nil
+}
+
+//otpauthURL - key URI for authenticator apps
+func (u User) otpauthURL(secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", mfaIssuer)
+	return "otpauth://totp/" + url.PathEscape(mfaIssuer+":"+u.Email) + "?" + v.Encode()
+}
+
+//EnableMFA - confirms pending secret with a code and returns recovery codes, which are shown only once
+func (u User) EnableMFA(store Store, code string) ([]string, error) {
+	m, err := store.MFAByUser(u.UUID)
+	if err != nil || m.Enabled {
+		return nil, fmt.Errorf("Two-factor authentication setup is not started")
+	}
+	if ok, err := m.verifyTOTP(store, code, time.Now()); err != nil || !ok {
+		return nil, mfaError{mfaInvalidTag, m.paramName()}
+	}
+	codes := make([]string, recoveryCodes)
+	hashes := make([]string, recoveryCodes)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		codes[i] = hex.EncodeToString(b)
+		hashes[i] = hashToken(codes[i])
+	}
+	m.RecoveryCodes = strings.Join(hashes, ",")
+	m.Enabled = true
+	m.UpdatedAt = time.Now()
+	if err := store.UpdateMFA(&m); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+//DisableMFA - removes second factor, requires valid code or recovery code
+func (u User) DisableMFA(store Store, code string) error {
+	m, err := store.MFAByUser(u.UUID)
+	if err != nil {
+		return fmt.Errorf("Two-factor authentication is not enabled")
+	}
+	if m.Enabled {
+		if err := m.check(store, code); err != nil {
+			return err
+		}
+	}
+	return store.DeleteMFA(u.UUID)
+}
+
+//checkMFA - verifies second factor of the user if it's enabled, codes are sign in parameters by name
+func (u User) checkMFA(store Store, codes map[string]string) error {
+	m, err := store.MFAByUser(u.UUID)
+	if err == errNotFound || (err == nil && !m.Enabled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	code, ok := codes[m.paramName()]
+	if !ok || code == "" {
+		return mfaError{mfaRequiredTag, m.paramName()}
+	}
+	return m.check(store, code)
+}
+
+//check - accepts current TOTP code or unused recovery code. Used codes can't be replayed
+func (m MFA) check(store Store, code string) error {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	ok, err := m.verifyTOTP(store, code, time.Now())
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	hashes := strings.Split(m.RecoveryCodes, ",")
+	hash := hashToken(strings.ToLower(code))
+	for i, h := range hashes {
+		if h != "" && subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			m.RecoveryCodes = strings.Join(append(hashes[:i:i], hashes[i+1:]...), ",")
+			m.UpdatedAt = time.Now()
+			log.Println("Recovery code used by", m.UserUUID)
+			return store.UpdateMFA(&m)
+		}
+	}
+	return mfaError{mfaInvalidTag, m.paramName()}
+}
+
+//verifyTOTP - checks code against previous, current and next time step (RFC 6238) and records the step used
+func (m *MFA) verifyTOTP(store Store, code string, now time.Time) (bool, error) {
+	if len(code) != totpDigits {
+		return false, nil
+	}
+	secret, legacy, err := decrypt(m.Secret)
+	if err != nil {
+		return false, err
+	}
+	if legacy {
+		// secrets of versions before key file are moved to the data key on first use
+		if m.Secret, err = encrypt(secret); err != nil {
+			return false, err
+		}
+		m.UpdatedAt = time.Now()
+		if err := store.UpdateMFA(m); err != nil {
+			return false, err
+		}
+		log.Println("MFA secret of", m.UserUUID, "re-encrypted with data key")
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return false, err
+	}
+	step := now.Unix() / int64(totpStep/time.Second)
+	for _, s := range []int64{step - 1, step, step + 1} {
+		if s <= m.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totp(key, s)), []byte(code)) == 1 {
+			m.LastStep = s
+			m.UpdatedAt = time.Now()
+			return true, store.UpdateMFA(m)
+		}
+	}
+	return false, nil
+}
+
+//totp - HOTP value (RFC 4226) for the time step
+func totp(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+//encrypt - AES-GCM with random nonce prepended to the ciphertext
+func encrypt(plaintext string) (string, error) {
+	key, err := keys.dataKey()
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+//decrypt - opens ciphertext with the data key, legacy is true when it was encrypted with legacyDataKey
+func decrypt(ciphertext string) (plaintext string, legacy bool, err error) {
+	key, err := keys.dataKey()
+	if err != nil {
+		return "", false, err
+	}
+	plaintext, err = decryptWith(key, ciphertext)
+	if err == nil {
+		return plaintext, false, nil
+	}
+	if plaintext, legacyErr := decryptWith(legacyDataKey(), ciphertext); legacyErr == nil {
+		return plaintext, true, nil
+	}
+	return "", false, err
+}
+
+func decryptWith(key []byte, ciphertext string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return "", fmt.Errorf("Invalid ciphertext")
+	}
+	plaintext, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//ResetMFA - removes second factor of the user with given email from command line
+func ResetMFA(email string) {
+	db.Init(cfg.DBDriver, dbDSN())
+	runMigrations()
+	store := NewSQLStore(db.Default())
+
+	user := NewUser()
+	if user.loadByEmail(store, email); user.UUID == "" {
+		log.Fatal("Unknown user: ", email)
+	}
+	if err := store.DeleteMFA(user.UUID); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Two-factor authentication was reset for", email)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"time"
 
@@ -11,23 +12,34 @@ import (
 
 //Migrate performs migration
 func Migrate() {
-	db.Init(cfg.DB)
-	migrations := getMigrations()
-	err := m.Exec(db.DB(), m.Up, migrations...)
+	db.Init(cfg.DBDriver, dbDSN())
+	runMigrations()
+	log.Println("Done")
+}
+
+//runMigrations applies pending migrations to the default database
+func runMigrations() {
+	migrator := m.NewMigrator(db.DB())
+	if db.Driver() == db.Postgres {
+		// several instances may start at once
+		migrator = m.NewPostgresMigrator(db.DB())
+	}
+	err := migrator.Exec(m.Up, getMigrations()...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("Done")
 }
 
 func getMigrations() []m.Migration {
 	migrations := []m.Migration{
 		{
 			ID: 1,
-			Up: m.Queries([]string{
-				"ALTER TABLE users ADD COLUMN pw_auth varchar(255);",
-				"ALTER TABLE users ADD COLUMN pw_salt varchar(255);",
-			}),
+			Up: func(tx *sql.Tx) error {
+				if err := addColumn(tx, "users", "pw_auth", "varchar(255)"); err != nil {
+					return err
+				}
+				return addColumn(tx, "users", "pw_salt", "varchar(255)")
+			},
 			Down: func(tx *sql.Tx) error {
 				// It's not possible to remove a column with sqlite.
 				return nil
@@ -43,7 +55,7 @@ func getMigrations() []m.Migration {
 					if u.Email == "" || u.PwNonce == "" {
 						continue
 					}
-					if _, err := tx.Exec("UPDATE `users` SET `pw_salt`=?, `updated_at`=? WHERE `uuid`=?", getSalt(u.Email, u.PwNonce), time.Now(), u.UUID); err != nil {
+					if _, err := tx.Exec(db.Rebind("UPDATE `users` SET `pw_salt`=?, `updated_at`=? WHERE `uuid`=?"), getSalt(u.Email, u.PwNonce), time.Now(), u.UUID); err != nil {
 						log.Println(err)
 					}
 				}
@@ -54,6 +66,114 @@ func getMigrations() []m.Migration {
 				return nil
 			},
 		},
+		{
+			// items are looked up by user and uuid, index on user_uuid alone is covered by the new one
+			ID: 3,
+			Up: m.Queries([]string{
+				"DROP INDEX IF EXISTS user_uuid;",
+				"CREATE UNIQUE INDEX IF NOT EXISTS user_item ON items (user_uuid, uuid);",
+			}),
+			Down: m.Queries([]string{
+				"DROP INDEX IF EXISTS user_item;",
+				"CREATE INDEX IF NOT EXISTS user_uuid ON items (user_uuid);",
+			}),
+		},
+		{
+			// sync tokens point to the per user change sequence instead of timestamps
+			ID: 4,
+			Up: func(tx *sql.Tx) error {
+				if err := addColumn(tx, "users", "change_seq", "bigint NOT NULL DEFAULT 0"); err != nil {
+					return err
+				}
+				if err := addColumn(tx, "items", "change_seq", "bigint NOT NULL DEFAULT 0"); err != nil {
+					return err
+				}
+				if err := backfillChangeSeq(tx); err != nil {
+					return err
+				}
+				_, err := tx.Exec("CREATE INDEX IF NOT EXISTS user_change_seq ON items (user_uuid, change_seq);")
+				return err
+			},
+			Down: func(tx *sql.Tx) error {
+				_, err := tx.Exec("DROP INDEX IF EXISTS user_change_seq;")
+				return err
+			},
+		},
+		{
+			// protocol version of the user's key params, empty for accounts registered before it was stored
+			ID: 5,
+			Up: func(tx *sql.Tx) error {
+				return addColumn(tx, "users", "version", "varchar(255) NOT NULL DEFAULT ''")
+			},
+			Down: func(tx *sql.Tx) error {
+				return nil
+			},
+		},
+		{
+			// accounts disabled by admin can't sign in
+			ID: 6,
+			Up: func(tx *sql.Tx) error {
+				if db.Driver() == db.Postgres {
+					return addColumn(tx, "users", "disabled", "boolean NOT NULL DEFAULT false")
+				}
+				return addColumn(tx, "users", "disabled", "integer(1) NOT NULL DEFAULT 0")
+			},
+			Down: func(tx *sql.Tx) error {
+				return nil
+			},
+		},
 	}
 	return migrations
 }
+
+//addColumn adds column to the table unless it's already there (fresh databases get it from the schema).
+//The column is looked up within the migration transaction, which sees its own changes and needs no other connection
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	exists, err := db.HasColumnTx(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+//backfillChangeSeq numbers existing items of every user in the order they were updated
+func backfillChangeSeq(tx *sql.Tx) error {
+	type row struct {
+		UUID     string
+		UserUUID string
+	}
+	rows, err := tx.Query(db.Rebind("SELECT `uuid`, `user_uuid` FROM `items` WHERE `change_seq`=0 ORDER BY `user_uuid`, `updated_at`, `uuid`"))
+	if err != nil {
+		return err
+	}
+	items := []row{}
+	for rows.Next() {
+		r := row{}
+		if err := rows.Scan(&r.UUID, &r.UserUUID); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, r)
+	}
+	rows.Close()
+	log.Println("Got", len(items), "items to number")
+
+	stmt, err := tx.Prepare(db.Rebind("UPDATE `items` SET `change_seq`=? WHERE `uuid`=?"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var seq int64
+	for i, item := range items {
+		if i == 0 || items[i-1].UserUUID != item.UserUUID {
+			seq = 0
+		}
+		seq++
+		if _, err := stmt.Exec(seq, item.UUID); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(db.Rebind("UPDATE `users` SET `change_seq`=(SELECT COALESCE(MAX(`change_seq`), 0) FROM `items` WHERE `items`.`user_uuid`=`users`.`uuid`)"))
+	return err
+}
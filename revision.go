@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+//Revision - previous encrypted version of an item
+type Revision struct {
+	UUID        string    `json:"uuid"         sql:"uuid"`
+	ItemUUID    string    `json:"item_uuid"    sql:"item_uuid"`
+	UserUUID    string    `json:"-"            sql:"user_uuid"`
+	Content     string    `json:"content"      sql:"content"`
+	ContentType string    `json:"content_type" sql:"content_type"`
+	EncItemKey  string    `json:"enc_item_key" sql:"enc_item_key"`
+	AuthHash    string    `json:"auth_hash"    sql:"auth_hash"`
+	CreatedAt   time.Time `json:"created_at"   sql:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"   sql:"updated_at"`
+}
+
+//Revisions - array of revisions
+type Revisions []Revision
+
+//newRevision - snapshot of the item as it is stored now, dated by the time this version was saved
+func newRevision(i Item) Revision {
+	return Revision{
+		UUID:        uuid.Must(uuid.NewV4()).String(),
+		ItemUUID:    i.UUID,
+		UserUUID:    i.UserUUID,
+		Content:     i.Content,
+		ContentType: i.ContentType,
+		EncItemKey:  i.EncItemKey,
+		AuthHash:    i.AuthHash,
+		CreatedAt:   i.UpdatedAt,
+		UpdatedAt:   i.UpdatedAt,
+	}
+}
+
+//ToJSON - revision listing without the payload
+func (r Revision) ToJSON() interface{} {
+	return data{
+		"uuid":         r.UUID,
+		"item_uuid":    r.ItemUUID,
+		"content_type": r.ContentType,
+		"created_at":   r.CreatedAt,
+		"updated_at":   r.UpdatedAt,
+	}
+}
+
+//keepRevision - stores current version of the item before it's overwritten and drops the oldest ones
+func keepRevision(w ItemWriter, current Item) error {
+	limit := revisionLimit(current.ContentType)
+	if limit == 0 || current.Deleted {
+		return nil
+	}
+	r := newRevision(current)
+	if err := w.CreateRevision(&r); err != nil {
+		return err
+	}
+	return w.PruneRevisions(current.UserUUID, current.UUID, limit)
+}
+
+//revisionLimit - number of revisions kept for content type, configured as "Note:30,*:5". Types without rule and without * keep none
+func revisionLimit(contentType string) int {
+	limits := map[string]int{}
+	for _, rule := range strings.Split(cfg.Revisions, ",") {
+		parts := strings.SplitN(strings.TrimSpace(rule), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 0 {
+			log.Println("Invalid revisions limit:", rule)
+			continue
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	if limit, ok := limits[contentType]; ok {
+		return limit
+	}
+	return limits["*"]
+}
+
+//GetRevisions - revisions of the user's item, newest first
+func (u User) GetRevisions(store Store, itemUUID string) (Revisions, error) {
+	if _, err := store.ItemByUUID(u.UUID, itemUUID); err != nil {
+		return nil, err
+	}
+	return store.ItemRevisions(u.UUID, itemUUID)
+}
+
+//GetRevision - single revision of the user's item
+func (u User) GetRevision(store Store, itemUUID, uuid string) (Revision, error) {
+	return store.RevisionByUUID(u.UUID, itemUUID, uuid)
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	httpext "github.com/go-playground/pkg/net/http"
 	"github.com/go-playground/pure"
+	"github.com/tectiv3/standardfile/db"
 )
 
 type data map[string]interface{}
@@ -22,58 +29,199 @@ func Log(v ...interface{}) {
 }
 
 type sfError struct {
-	Message string `json:"message"`
-	Code    int    `json:"code"`
+	Message string      `json:"message"`
+	Code    int         `json:"code"`
+	Tag     string      `json:"tag,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
 }
 
 func showError(w http.ResponseWriter, err error, code int) {
 	log.Println(err)
-	pure.JSON(w, code, data{"error": sfError{err.Error(), code}})
+	e := sfError{Message: err.Error(), Code: code}
+	switch err := err.(type) {
+	case mfaError:
+		e.Tag = err.tag
+		e.Payload = data{"mfa_key": err.key}
+	case lockoutError:
+		e.Code = http.StatusTooManyRequests
+		e.Tag = lockedTag
+		e.Payload = data{"retry_after": err.retryAfter()}
+		w.Header().Set("Retry-After", strconv.Itoa(err.retryAfter()))
+		code = e.Code
+	case scopeError:
+		e.Code = http.StatusForbidden
+		code = e.Code
+	}
+	pure.JSON(w, code, data{"error": e})
 }
 
-func authenticateUser(r *http.Request) (User, error) {
-	var user = NewUser()
+//authenticateUser - accepts access token of a session, or API token having all of the scopes.
+//Routes without scopes can't be used with API tokens
+func (srv *Server) authenticateUser(r *http.Request, scopes ...string) (User, error) {
+	if token := bearerToken(r); strings.HasPrefix(token, apiTokenPrefix) {
+		return authenticateAPIToken(srv.store, token, scopes)
+	}
+	user, _, err := srv.authenticateSession(r)
+	return user, err
+}
 
+//bearerToken - token from authorization header
+func bearerToken(r *http.Request) string {
 	authHeaderParts := strings.Split(r.Header.Get("Authorization"), " ")
 	if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != "bearer" {
-		return user, fmt.Errorf("Missing authorization header")
+		return ""
+	}
+	return authHeaderParts[1]
+}
+
+//authenticateSession - checks access token and returns its user and session
+func (srv *Server) authenticateSession(r *http.Request) (User, Session, error) {
+	var user = NewUser()
+
+	token := bearerToken(r)
+	if token == "" {
+		return user, Session{}, fmt.Errorf("Missing authorization header")
+	}
+
+	claims, err := parseToken(token)
+	if err != nil {
+		return user, Session{}, err
 	}
+	Log("Token is valid, claims: ", claims)
 
-	token, err := jwt.ParseWithClaims(authHeaderParts[1], &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	if ok := user.LoadByUUID(srv.store, claims.UUID); !ok || user.Disabled {
+		return user, Session{}, fmt.Errorf("Unknown user")
+	}
+
+	// tokens issued before sessions were introduced can't be revoked and are no longer accepted,
+	// sessions are revoked on password change
+	session, err := srv.store.SessionByUUID(user.UUID, claims.SessionID)
+	if err != nil {
+		return user, Session{}, fmt.Errorf("Invalid session")
+	}
+	if session.idle() {
+		Log("Idle session expired:", session.UUID)
+		if err := srv.store.DeleteSession(user.UUID, session.UUID); err != nil {
+			Log("Session delete failed:", err)
 		}
-		return SigningKey, nil
-	})
+		return user, Session{}, fmt.Errorf("Session expired")
+	}
+	if err := session.touch(srv.store, clientInfo(r, "")); err != nil {
+		Log("Session touch failed:", err)
+	}
+
+	return user, session, nil
+}
 
+//parseToken - checks signature and expiration of access token. Claims are returned along with validation error
+func parseToken(tokenString string) (*UserClaims, error) {
+	claims := &UserClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.verificationKey)
 	if err != nil {
-		return user, err
+		return claims, err
 	}
+	if !token.Valid {
+		return claims, fmt.Errorf("Invalid token")
+	}
+	return claims, nil
+}
 
-	if claims, ok := token.Claims.(*UserClaims); ok && token.Valid {
-		Log("Token is valid, claims: ", claims)
+//clientInfo - describes client making request
+func clientInfo(r *http.Request, api string) Client {
+	return Client{
+		API:       api,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+}
+
+//trustedProxies - networks of reverse proxies whose X-Real-IP and X-Forwarded-For headers are honoured
+var trustedProxies []*net.IPNet
 
-		if ok := user.LoadByUUID(claims.UUID); !ok {
-			return user, fmt.Errorf("Unknown user")
+//UseTrustedProxies - sets reverse proxies from comma separated addresses and networks, e.g. "127.0.0.1,10.0.0.0/8"
+func UseTrustedProxies(list string) error {
+	proxies := []*net.IPNet{}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
 		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("Invalid trusted proxy: %v", err)
+		}
+		proxies = append(proxies, network)
+	}
+	trustedProxies = proxies
+	return nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-		if user.Validate(claims.PwHash) {
-			return user, nil
+//clientIP - address of the client. Proxy headers are used only when the request comes from trusted proxy
+//or unix socket, X-Forwarded-For is read from the right up to the first address that isn't a proxy
+func clientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	// unix socket connections come from the proxy in front of the server
+	if !isTrustedProxy(remote) && !(len(cfg.Socket) != 0 && net.ParseIP(remote) == nil) {
+		return remote
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		remote = ip
+		if !isTrustedProxy(ip) {
+			break
 		}
 	}
+	return remote
+}
 
-	return user, fmt.Errorf("Invalid token")
+//signedIn - responds with tokens of the new session, clients with sessions support also get refresh token
+func signedIn(w http.ResponseWriter, code int, user User, tokens SessionTokens) {
+	response := data{"token": tokens.AccessToken, "user": user.ToJSON()}
+	if tokens.RefreshToken != "" {
+		response["session"] = tokens
+	}
+	pure.JSON(w, code, response)
 }
 
 //Dashboard - is the root handler
-func Dashboard(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) Dashboard(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Dashboard. Server version: " + Version))
 }
 
 //ChangePassword - is the change password handler
-func ChangePassword(w http.ResponseWriter, r *http.Request) {
-	user, err := authenticateUser(r)
+func (srv *Server) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
 	if err != nil {
 		showError(w, err, http.StatusUnauthorized)
 		return
@@ -89,27 +237,86 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := user.Login(np.Email, np.CurrentPassword); err != nil {
+	if np.Version != "" {
+		params := np.User
+		if err := params.validateParams(); err != nil {
+			showError(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if !user.VerifyPassword(np.CurrentPassword) {
 		showError(w, fmt.Errorf("The current password you entered is incorrect. Please try again."), http.StatusUnauthorized)
 		return
 	}
 
-	if err := user.UpdatePassword(np); err != nil {
+	if err := user.UpdatePassword(srv.store, np); err != nil {
 		showError(w, err, http.StatusInternalServerError)
 		return
 	}
 	// c.Code(http.StatusNoContent).Body("") //in spec, but SN requires token in return
-	token, err := user.Login(user.Email, user.Password)
+	tokens, err := user.startSession(srv.store, clientInfo(r, np.API))
+	if err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	signedIn(w, http.StatusAccepted, user, tokens)
+}
+
+//ChangeEmail - changes email with new password and key params, as the keys are derived from email
+func (srv *Server) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
 	if err != nil {
 		showError(w, err, http.StatusUnauthorized)
 		return
 	}
-	pure.JSON(w, http.StatusAccepted, data{"token": token, "user": user.ToJSON()})
+	np := NewPassword{}
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &np); err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if len(np.CurrentPassword) == 0 {
+		showError(w, fmt.Errorf("Your current password is required to change your email."), http.StatusUnauthorized)
+		return
+	}
+
+	if np.NewEmail == "" || np.NewPassword == "" {
+		showError(w, fmt.Errorf("New email and password are required"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if np.Version != "" {
+		params := np.User
+		if err := params.validateParams(); err != nil {
+			showError(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if !user.VerifyPassword(np.CurrentPassword) {
+		showError(w, fmt.Errorf("The current password you entered is incorrect. Please try again."), http.StatusUnauthorized)
+		return
+	}
+
+	if err := user.ChangeEmail(srv.store, np); err == errEmailTaken {
+		showError(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	tokens, err := user.startSession(srv.store, clientInfo(r, np.API))
+	if err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	signedIn(w, http.StatusAccepted, user, tokens)
 }
 
 //UpdateUser - updates user params
-func UpdateUser(w http.ResponseWriter, r *http.Request) {
-	user, err := authenticateUser(r)
+func (srv *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
 	if err != nil {
 		showError(w, err, http.StatusUnauthorized)
 		return
@@ -121,47 +328,228 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	Log("Request:", p)
 
-	if err := user.UpdateParams(p); err != nil {
+	if err := user.UpdateParams(srv.store, p); err != nil {
 		showError(w, err, http.StatusInternalServerError)
 		return
 	}
 	pure.JSON(w, http.StatusAccepted, data{})
 }
 
+//authRequest - incoming registration or sign in
+type authRequest struct {
+	User
+	API string `json:"api"`
+	// Invite - code required for registration when invites are enabled
+	Invite string `json:"invite"`
+	// MFA - second factor codes, parameter name contains uuid of the user's second factor
+	MFA map[string]string `json:"-"`
+}
+
+//UnmarshalJSON - decodes request collecting mfa_<uuid> parameters
+func (a *authRequest) UnmarshalJSON(b []byte) error {
+	type fields authRequest
+	if err := json.Unmarshal(b, (*fields)(a)); err != nil {
+		return err
+	}
+	params := map[string]interface{}{}
+	if err := json.Unmarshal(b, &params); err != nil {
+		return err
+	}
+	for name, value := range params {
+		if code, ok := value.(string); ok && strings.HasPrefix(name, "mfa_") {
+			a.setMFA(name, code)
+		}
+	}
+	return nil
+}
+
+func (a *authRequest) setMFA(name, code string) {
+	if a.MFA == nil {
+		a.MFA = map[string]string{}
+	}
+	a.MFA[name] = code
+}
+
+//decodeAuthRequest - reads sign in parameters from body, form or query
+func decodeAuthRequest(r *http.Request) (authRequest, error) {
+	var req = authRequest{User: NewUser()}
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &req); err != nil {
+		return req, err
+	}
+	r.ParseForm()
+	for name, values := range r.Form {
+		if strings.HasPrefix(name, "mfa_") && len(values) > 0 {
+			req.setMFA(name, values[0])
+		}
+	}
+	return req, nil
+}
+
 //Registration - is the registration handler
-func Registration(w http.ResponseWriter, r *http.Request) {
-	var user = NewUser()
-	if err := pure.Decode(r, httpext.QueryParams, 104857600, &user); err != nil {
+func (srv *Server) Registration(w http.ResponseWriter, r *http.Request) {
+	var req = authRequest{User: NewUser()}
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &req); err != nil {
 		showError(w, err, http.StatusUnprocessableEntity)
 		return
 	}
-	Log("Request:", user)
-	token, err := user.Register()
+	Log("Request:", req)
+	user := req.User
+	tokens, err := user.Register(srv.store, req.Invite, clientInfo(r, req.API))
 	if err != nil {
 		showError(w, err, http.StatusUnprocessableEntity)
 		return
 	}
-	pure.JSON(w, http.StatusCreated, data{"token": token, "user": user.ToJSON()})
+	signedIn(w, http.StatusCreated, user, tokens)
 }
 
 //Login - is the login handler
-func Login(w http.ResponseWriter, r *http.Request) {
-	var user = NewUser()
-	if err := pure.Decode(r, httpext.QueryParams, 104857600, &user); err != nil {
+func (srv *Server) Login(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeAuthRequest(r)
+	if err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	Log("Request:", req.Email)
+	user := req.User
+	tokens, err := user.Login(srv.store, user.Email, user.Password, req.MFA, clientInfo(r, req.API))
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	signedIn(w, http.StatusAccepted, user, tokens)
+}
+
+//DeleteAccount - deletes signed in user with all their data, requires password and second factor if enabled
+func (srv *Server) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	req, err := decodeAuthRequest(r)
+	if err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if !user.VerifyPassword(req.Password) {
+		showError(w, fmt.Errorf("The password you entered is incorrect. Please try again."), http.StatusUnauthorized)
+		return
+	}
+	if err := user.checkMFA(srv.store, req.MFA); err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err := user.Delete(srv.store); err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//SignOut - revokes current session
+func (srv *Server) SignOut(w http.ResponseWriter, r *http.Request) {
+	user, session, err := srv.authenticateSession(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err := user.RevokeSession(srv.store, session.UUID); err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//ListSessions - lists active sessions of the user
+func (srv *Server) ListSessions(w http.ResponseWriter, r *http.Request) {
+	user, current, err := srv.authenticateSession(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	sessions, err := user.GetSessions(srv.store)
+	if err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	list := []interface{}{}
+	for _, s := range sessions {
+		list = append(list, s.ToJSON(s.UUID == current.UUID))
+	}
+	pure.JSON(w, http.StatusOK, list)
+}
+
+//RevokeSession - revokes one of the other sessions of the user
+func (srv *Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user, current, err := srv.authenticateSession(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		UUID string `json:"uuid"`
+	}
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &req); err != nil {
 		showError(w, err, http.StatusUnprocessableEntity)
 		return
 	}
-	Log("Request:", user)
-	token, err := user.Login(user.Email, user.Password)
+	if req.UUID == "" {
+		showError(w, fmt.Errorf("Please provide the session identifier"), http.StatusBadRequest)
+		return
+	}
+	if req.UUID == current.UUID {
+		showError(w, fmt.Errorf("You can not delete your current session"), http.StatusBadRequest)
+		return
+	}
+	if _, err := srv.store.SessionByUUID(user.UUID, req.UUID); err != nil {
+		showError(w, fmt.Errorf("No session exists with the provided identifier"), http.StatusBadRequest)
+		return
+	}
+	if err := user.RevokeSession(srv.store, req.UUID); err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//RevokeOtherSessions - revokes all sessions of the user except current one
+func (srv *Server) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user, current, err := srv.authenticateSession(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err := user.RevokeOtherSessions(srv.store, current.UUID); err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//RefreshSession - issues new access and refresh tokens
+func (srv *Server) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &req); err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if req.AccessToken == "" || req.RefreshToken == "" {
+		showError(w, fmt.Errorf("Please provide all required parameters"), http.StatusBadRequest)
+		return
+	}
+	tokens, err := refreshSession(srv.store, req.AccessToken, req.RefreshToken, clientInfo(r, ""))
 	if err != nil {
 		showError(w, err, http.StatusUnauthorized)
 		return
 	}
-	pure.JSON(w, http.StatusAccepted, data{"token": token, "user": user.ToJSON()})
+	pure.JSON(w, http.StatusOK, data{"session": tokens})
 }
 
 //GetParams - is the get auth parameters handler
-func GetParams(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) GetParams(w http.ResponseWriter, r *http.Request) {
 	user := NewUser()
 	email := r.FormValue("email")
 	Log("Request:", string(email))
@@ -169,9 +557,13 @@ func GetParams(w http.ResponseWriter, r *http.Request) {
 		showError(w, fmt.Errorf("Empty email"), http.StatusUnauthorized)
 		return
 	}
-	params := user.GetParams(email)
-	if _, ok := params["version"]; !ok {
-		showError(w, fmt.Errorf("Invalid email or password"), http.StatusNotFound)
+	if err := loginAttempts.check(email, clientIP(r)); err != nil {
+		showError(w, err, http.StatusTooManyRequests)
+		return
+	}
+	params, err := user.GetParams(srv.store, email)
+	if err != nil {
+		showError(w, err, http.StatusInternalServerError)
 		return
 	}
 	content, _ := json.MarshalIndent(params, "", "  ")
@@ -180,19 +572,23 @@ func GetParams(w http.ResponseWriter, r *http.Request) {
 }
 
 //SyncItems - is the items sync handler
-func SyncItems(w http.ResponseWriter, r *http.Request) {
-	user, err := authenticateUser(r)
-	if err != nil {
-		showError(w, err, http.StatusUnauthorized)
-		return
-	}
+func (srv *Server) SyncItems(w http.ResponseWriter, r *http.Request) {
 	var request SyncRequest
 	if err := pure.Decode(r, httpext.QueryParams, 104857600, &request); err != nil {
 		showError(w, err, http.StatusUnprocessableEntity)
 		return
 	}
+	scopes := []string{scopeItemsRead}
+	if len(request.Items) > 0 {
+		scopes = append(scopes, scopeItemsWrite)
+	}
+	user, err := srv.authenticateUser(r, scopes...)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
 	Log("Request:", request)
-	response, err := user.SyncItems(request)
+	response, err := user.SyncItems(srv.store, request)
 	if err != nil {
 		showError(w, err, http.StatusInternalServerError)
 		return
@@ -202,12 +598,323 @@ func SyncItems(w http.ResponseWriter, r *http.Request) {
 	pure.JSON(w, http.StatusAccepted, response)
 }
 
-//BackupItems - export items
-func BackupItems(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+//ItemRevisions - lists revisions of an item
+func (srv *Server) ItemRevisions(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r, scopeItemsRead)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	revisions, err := user.GetRevisions(srv.store, pure.RequestVars(r).URLParam("uuid"))
+	if err == errNotFound {
+		showError(w, fmt.Errorf("Item not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	list := []interface{}{}
+	for _, revision := range revisions {
+		list = append(list, revision.ToJSON())
+	}
+	pure.JSON(w, http.StatusOK, list)
+}
+
+//ItemRevision - returns single revision of an item with its content
+func (srv *Server) ItemRevision(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r, scopeItemsRead)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	vars := pure.RequestVars(r)
+	revision, err := user.GetRevision(srv.store, vars.URLParam("uuid"), vars.URLParam("id"))
+	if err == errNotFound {
+		showError(w, fmt.Errorf("Revision not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	pure.JSON(w, http.StatusOK, revision)
+}
+
+//ImportItems - imports items from encrypted backup file, uuid collisions are handled according to on_conflict
+func (srv *Server) ImportItems(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r, scopeItemsWrite)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	backup, err := readBackup(http.MaxBytesReader(w, r.Body, 104857600))
+	if err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	result, err := user.Import(srv.store, backup.Items, r.URL.Query().Get("on_conflict"))
+	if err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	pure.JSON(w, http.StatusAccepted, result)
+}
+
+//MFAStatus - shows whether second factor is enabled
+func (srv *Server) MFAStatus(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
 	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	m, err := srv.store.MFAByUser(user.UUID)
+	if err != nil && err != errNotFound {
 		showError(w, err, http.StatusInternalServerError)
 		return
 	}
-	fmt.Printf("%+v\n", r.Form)
+	pure.JSON(w, http.StatusOK, data{"enabled": m.Enabled})
+}
+
+//StartMFA - generates TOTP secret to be added to authenticator app
+func (srv *Server) StartMFA(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	m, secret, err := user.StartMFA(srv.store)
+	if err != nil {
+		showError(w, err, http.StatusBadRequest)
+		return
+	}
+	pure.JSON(w, http.StatusCreated, data{"uuid": m.UUID, "secret": secret, "otpauth_url": user.otpauthURL(secret)})
+}
+
+//mfaRequest - code confirming second factor change
+type mfaRequest struct {
+	Code string `json:"code"`
+}
+
+//EnableMFA - enables second factor once the code from authenticator app is confirmed
+func (srv *Server) EnableMFA(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var req mfaRequest
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &req); err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	codes, err := user.EnableMFA(srv.store, req.Code)
+	if err != nil {
+		showError(w, err, http.StatusBadRequest)
+		return
+	}
+	pure.JSON(w, http.StatusOK, data{"recovery_codes": codes})
+}
+
+//DisableMFA - removes second factor, requires current code or recovery code
+func (srv *Server) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var req mfaRequest
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &req); err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if err := user.DisableMFA(srv.store, req.Code); err != nil {
+		showError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//ListAPITokens - lists API tokens of the user
+func (srv *Server) ListAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	tokens, err := user.GetAPITokens(srv.store)
+	if err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	pure.JSON(w, http.StatusOK, tokens)
+}
+
+//apiTokenRequest - new API token, expires_at is optional
+type apiTokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+//CreateAPIToken - creates API token, which is returned only in this response
+func (srv *Server) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var req apiTokenRequest
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &req); err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	expiresAt := time.Time{}
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	t, token, err := user.CreateAPIToken(srv.store, req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	pure.JSON(w, http.StatusCreated, data{"token": token, "api_token": t})
+}
+
+//RevokeAPIToken - deletes API token with given uuid
+func (srv *Server) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		UUID string `json:"uuid"`
+	}
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &req); err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if req.UUID == "" {
+		showError(w, fmt.Errorf("Please provide the token identifier"), http.StatusBadRequest)
+		return
+	}
+	if err := user.RevokeAPIToken(srv.store, req.UUID); err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//ShowSettings - email notification settings of the user
+func (srv *Server) ShowSettings(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	settings, err := user.GetSettings(srv.store)
+	if err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	pure.JSON(w, http.StatusOK, settings)
+}
+
+//settingsRequest - changed settings, missing ones are kept
+type settingsRequest struct {
+	EmailBackups *bool `json:"email_backups"`
+	SignInAlerts *bool `json:"sign_in_alerts"`
+}
+
+//UpdateSettings - turns email backups and sign in alerts on or off
+func (srv *Server) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	var req settingsRequest
+	if err := pure.Decode(r, httpext.QueryParams, 104857600, &req); err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	settings, err := user.GetSettings(srv.store)
+	if err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if req.EmailBackups != nil {
+		settings.EmailBackups = *req.EmailBackups
+	}
+	if req.SignInAlerts != nil {
+		settings.SignInAlerts = *req.SignInAlerts
+	}
+	if err := user.SaveSettings(srv.store, settings); err != nil {
+		showError(w, err, http.StatusInternalServerError)
+		return
+	}
+	pure.JSON(w, http.StatusOK, settings)
+}
+
+//AdminSnapshot - downloads consistent copy of the database, requires admin_token
+func (srv *Server) AdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(adminToken)) != 1 {
+		showError(w, fmt.Errorf("Invalid admin token"), http.StatusUnauthorized)
+		return
+	}
+	sending := false
+	err := withSnapshot(srv.store, func(f *os.File) error {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		sending = true
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", `attachment; filename="sf-`+time.Now().Format("20060102-150405")+`.db"`)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		_, err = io.Copy(w, f)
+		return err
+	})
+	switch {
+	case err == nil:
+	case sending:
+		log.Println("Sending snapshot failed:", err)
+	case err == db.ErrNoSnapshot:
+		showError(w, err, http.StatusNotImplemented)
+	default:
+		showError(w, err, http.StatusInternalServerError)
+	}
+}
+
+//ItemRoute - GET /api/items/:uuid, only backup is served there
+func (srv *Server) ItemRoute(w http.ResponseWriter, r *http.Request) {
+	if pure.RequestVars(r).URLParam("uuid") == "backup" {
+		srv.BackupItems(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+//BackupItems - export items as encrypted backup file
+func (srv *Server) BackupItems(w http.ResponseWriter, r *http.Request) {
+	user, err := srv.authenticateUser(r, scopeBackup)
+	if err != nil {
+		showError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		showError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	filter := newItemFilter(r)
+	Log("Backup:", user.UUID, filter)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="Standard Notes Backup - %s.txt"`, time.Now().Format("2006-01-02")))
+	w.WriteHeader(http.StatusOK)
+	// headers are already sent, an error leaves the file truncated and invalid
+	if err := user.WriteBackup(srv.store, w, filter); err != nil {
+		log.Println("Backup failed:", err)
+	}
 }
@@ -0,0 +1,1171 @@
+package main_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	sf "github.com/tectiv3/standardfile"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "standardfile")
+	if err != nil {
+		panic(err)
+	}
+	if err := sf.LoadKeys(filepath.Join(dir, "keys.json")); err != nil {
+		panic(err)
+	}
+	stop := openPostgres()
+	code := m.Run()
+	stop()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func request(t *testing.T, handler http.HandlerFunc, method, url, token, body string) (int, map[string]interface{}) {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal("Invalid response:", w.Body.String())
+	}
+	return w.Code, result
+}
+
+//registerMemoryUser - registers user on new server with its own memory store
+func registerMemoryUser(t *testing.T) (*sf.Server, string) {
+	srv := sf.NewServer(sf.NewMemoryStore())
+	return srv, registerUser(t, srv, "mem@local")
+}
+
+func registerUser(t *testing.T, srv *sf.Server, email string) string {
+	code, res := request(t, srv.Registration, "POST", "/api/auth", "", `{"email":"`+email+`","password":"secret","pw_cost":110000,"pw_nonce":"nonce"}`)
+	if code != http.StatusCreated {
+		t.Fatal("Registration failed:", code, res)
+	}
+	return res["token"].(string)
+}
+
+func TestAuthHandlers(t *testing.T) {
+	srv, _ := registerMemoryUser(t)
+
+	code, res := request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`)
+	if code != http.StatusAccepted || res["token"] == "" {
+		t.Error("Login failed:", code, res)
+	}
+
+	code, _ = request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"wrong"}`)
+	if code != http.StatusUnauthorized {
+		t.Error("Login with wrong password should fail:", code)
+	}
+
+	code, res = request(t, srv.GetParams, "GET", "/api/auth/params?email=mem@local", "", "")
+	if code != http.StatusOK || res["pw_cost"].(float64) != 110000 || res["pw_nonce"] != "nonce" {
+		t.Error("Unexpected params:", code, res)
+	}
+}
+
+func TestSyncItems(t *testing.T) {
+	t.Parallel()
+	srv, token := registerMemoryUser(t)
+
+	code, res := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"item-1","content":"001abc","content_type":"Note","enc_item_key":"key"}]}`)
+	if code != http.StatusAccepted {
+		t.Fatal("Sync failed:", code, res)
+	}
+	saved := res["saved_items"].([]interface{})
+	if len(saved) != 1 || saved[0].(map[string]interface{})["content"] != "001abc" {
+		t.Fatal("Unexpected saved items:", saved)
+	}
+
+	code, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`)
+	retrieved := res["retrieved_items"].([]interface{})
+	if code != http.StatusAccepted || len(retrieved) != 1 {
+		t.Error("Unexpected retrieved items:", code, retrieved)
+	}
+
+	code, _ = request(t, srv.SyncItems, "POST", "/api/items/sync", "invalid", `{"items":[]}`)
+	if code != http.StatusUnauthorized {
+		t.Error("Sync with invalid token should fail:", code)
+	}
+}
+
+func TestSyncPagination(t *testing.T) {
+	t.Parallel()
+	srv, token := registerMemoryUser(t)
+
+	items := []string{}
+	for _, uuid := range []string{"item-1", "item-2", "item-3", "item-4", "item-5"} {
+		items = append(items, `{"uuid":"`+uuid+`","content":"001abc","content_type":"Note"}`)
+	}
+	code, res := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[`+strings.Join(items, ",")+`]}`)
+	if code != http.StatusAccepted {
+		t.Fatal("Sync failed:", code, res)
+	}
+
+	seen := map[string]int{}
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[],"limit":2,"cursor_token":"`+cursor+`"}`)
+		retrieved := res["retrieved_items"].([]interface{})
+		if len(retrieved) > 2 {
+			t.Fatal("Limit is not honored:", len(retrieved))
+		}
+		for _, item := range retrieved {
+			seen[item.(map[string]interface{})["uuid"].(string)]++
+		}
+		if page == 0 {
+			// item updated mid-pagination moves to the end of the list
+			request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"item-1","content":"002abc","content_type":"Note"}],"limit":1}`)
+		}
+		next, ok := res["cursor_token"].(string)
+		if !ok {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != 5 {
+		t.Error("Not all items were retrieved:", seen)
+	}
+	if seen["item-1"] != 2 {
+		t.Error("Updated item should be retrieved again:", seen)
+	}
+}
+
+func TestSyncDeleteMissing(t *testing.T) {
+	t.Parallel()
+	srv, token := registerMemoryUser(t)
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-1","content":"001abc","content_type":"Note"}]}`)
+
+	_, res := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"missing-1","deleted":true},{"uuid":"note-1","deleted":true}]}`)
+	saved, unsaved := res["saved_items"].([]interface{}), res["unsaved"].([]interface{})
+	if len(unsaved) != 1 || unsaved[0].(map[string]interface{})["item"].(map[string]interface{})["uuid"] != "missing-1" {
+		t.Error("Deleting missing item should be unsaved:", res)
+	}
+	if len(saved) != 1 || saved[0].(map[string]interface{})["uuid"] != "note-1" {
+		t.Error("Deleting existing item should be saved:", res)
+	}
+
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"api":"20190520","items":[{"uuid":"missing-2","deleted":true}]}`)
+	if len(res["saved_items"].([]interface{})) != 0 || len(res["unsaved"].([]interface{})) != 1 {
+		t.Error("Deleting missing item should be unsaved with API 20190520:", res)
+	}
+}
+
+func TestSyncInvalidLimit(t *testing.T) {
+	t.Parallel()
+	srv, token := registerMemoryUser(t)
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"item-1","content":"001abc","content_type":"Note"}]}`)
+
+	for _, limit := range []string{"-1", "-100", "0"} {
+		code, res := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[],"limit":`+limit+`}`)
+		if code != http.StatusAccepted {
+			t.Fatal("Sync with limit", limit, "failed:", code, res)
+		}
+		if retrieved := res["retrieved_items"].([]interface{}); len(retrieved) != 1 {
+			t.Error("Limit", limit, "should fall back to default:", retrieved)
+		}
+	}
+}
+
+func TestSyncConflicts(t *testing.T) {
+	t.Parallel()
+	srv, token := registerMemoryUser(t)
+
+	_, res := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"api":"20190520","items":[{"uuid":"item-1","content":"001abc","content_type":"Note"}]}`)
+	saved := res["saved_items"].([]interface{})[0].(map[string]interface{})
+	updatedAt := saved["updated_at"].(string)
+
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"api":"20190520","items":[{"uuid":"item-1","content":"002abc","content_type":"Note","updated_at":"`+updatedAt+`"}]}`)
+	if len(res["saved_items"].([]interface{})) != 1 || len(res["conflicts"].([]interface{})) != 0 {
+		t.Fatal("Item with current updated_at should be saved:", res)
+	}
+
+	// stale update from another device
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"api":"20190520","items":[{"uuid":"item-1","content":"003abc","content_type":"Note","updated_at":"`+updatedAt+`"}]}`)
+	conflicts := res["conflicts"].([]interface{})
+	if len(res["saved_items"].([]interface{})) != 0 || len(conflicts) != 1 {
+		t.Fatal("Stale item should be reported as conflict:", res)
+	}
+	c := conflicts[0].(map[string]interface{})
+	if c["type"] != "sync_conflict" || c["server_item"].(map[string]interface{})["content"] != "002abc" {
+		t.Error("Unexpected conflict:", c)
+	}
+
+	other := registerUser(t, srv, "other@local")
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", other, `{"api":"20190520","items":[{"uuid":"item-1","content":"004abc","content_type":"Note"}]}`)
+	conflicts = res["conflicts"].([]interface{})
+	if len(conflicts) != 1 || conflicts[0].(map[string]interface{})["type"] != "uuid_conflict" {
+		t.Error("Foreign uuid should be reported as uuid_conflict:", res)
+	}
+
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", other, `{"items":[{"uuid":"item-1","content":"005abc","content_type":"Note"}]}`)
+	unsaved := res["unsaved"].([]interface{})
+	if len(unsaved) != 1 || unsaved[0].(map[string]interface{})["error"].(map[string]interface{})["tag"] != "uuid_conflict" {
+		t.Error("Legacy sync should report foreign uuid as unsaved:", res)
+	}
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`)
+	if item := res["retrieved_items"].([]interface{})[0].(map[string]interface{}); item["content"] != "002abc" {
+		t.Error("Item of another user was overwritten:", item)
+	}
+}
+
+//racingStore - runs update right before the next batch is written, as if another device synced at the same time
+type racingStore struct {
+	sf.Store
+	update func()
+}
+
+func (s *racingStore) WriteItems(fn func(w sf.ItemWriter) error) error {
+	if update := s.update; update != nil {
+		s.update = nil
+		update()
+	}
+	return s.Store.WriteItems(fn)
+}
+
+func TestSyncConcurrentUpdates(t *testing.T) {
+	t.Parallel()
+	store := &racingStore{Store: sf.NewMemoryStore()}
+	srv := sf.NewServer(store)
+	token := registerUser(t, srv, "mem@local")
+	_, res := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"api":"20190520","items":[{"uuid":"item-1","content":"001abc","content_type":"Note"}]}`)
+	updatedAt := res["saved_items"].([]interface{})[0].(map[string]interface{})["updated_at"].(string)
+
+	store.update = func() {
+		request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"api":"20190520","items":[{"uuid":"item-1","content":"002abc","content_type":"Note","updated_at":"`+updatedAt+`"}]}`)
+	}
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"api":"20190520","items":[{"uuid":"item-1","content":"003abc","content_type":"Note","updated_at":"`+updatedAt+`"}]}`)
+	conflicts := res["conflicts"].([]interface{})
+	if len(res["saved_items"].([]interface{})) != 0 || len(conflicts) != 1 {
+		t.Fatal("Item changed while syncing should be reported as conflict:", res)
+	}
+	if c := conflicts[0].(map[string]interface{}); c["server_item"].(map[string]interface{})["content"] != "002abc" {
+		t.Error("Concurrent change was overwritten:", c)
+	}
+}
+
+func TestSyncTokens(t *testing.T) {
+	t.Parallel()
+	srv, token := registerMemoryUser(t)
+
+	_, res := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"item-1","content":"001abc","content_type":"Note"}]}`)
+	syncToken := res["sync_token"].(string)
+	if decoded, _ := base64.URLEncoding.DecodeString(syncToken); string(decoded) != "2:1" {
+		t.Fatal("Unexpected sync token:", string(decoded))
+	}
+
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[],"sync_token":"`+syncToken+`"}`)
+	if len(res["retrieved_items"].([]interface{})) != 0 || res["sync_token"] != syncToken {
+		t.Error("Nothing should change after own sync:", res)
+	}
+
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"item-2","content":"001abc","content_type":"Note"}]}`)
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[],"sync_token":"`+syncToken+`"}`)
+	retrieved := res["retrieved_items"].([]interface{})
+	if len(retrieved) != 1 || retrieved[0].(map[string]interface{})["uuid"] != "item-2" {
+		t.Error("Change made by another client should be retrieved:", res)
+	}
+
+	legacy := base64.URLEncoding.EncodeToString([]byte("1:0"))
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[],"sync_token":"`+legacy+`"}`)
+	if len(res["retrieved_items"].([]interface{})) != 2 {
+		t.Error("Legacy token should still be accepted:", res)
+	}
+	if decoded, _ := base64.URLEncoding.DecodeString(res["sync_token"].(string)); string(decoded) != "2:2" {
+		t.Error("Legacy token should be upgraded:", string(decoded))
+	}
+}
+
+//failingStore - fails to create the item with given uuid, as if the database went away mid-batch
+type failingStore struct {
+	sf.Store
+	uuid string
+}
+
+func (s failingStore) WriteItems(fn func(w sf.ItemWriter) error) error {
+	return s.Store.WriteItems(func(w sf.ItemWriter) error {
+		return fn(failingWriter{w, s.uuid})
+	})
+}
+
+type failingWriter struct {
+	sf.ItemWriter
+	uuid string
+}
+
+func (w failingWriter) CreateItem(i *sf.Item) error {
+	if i.UUID == w.uuid {
+		return errors.New("disk I/O error")
+	}
+	return w.ItemWriter.CreateItem(i)
+}
+
+func TestSyncBatch(t *testing.T) {
+	t.Parallel()
+	srv, token := registerMemoryUser(t)
+
+	_, res := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"item-1","content":"001abc","content_type":"Note"},{"deleted":true},{"uuid":"item-2","content":"001abc","content_type":"Note"}]}`)
+	if len(res["saved_items"].([]interface{})) != 2 || len(res["unsaved"].([]interface{})) != 1 {
+		t.Fatal("Invalid item should not prevent saving the rest:", res)
+	}
+
+	srv = sf.NewServer(failingStore{sf.NewMemoryStore(), "item-2"})
+	token = registerUser(t, srv, "mem@local")
+	code, _ := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"item-1","content":"001abc","content_type":"Note"},{"uuid":"item-2","content":"001abc","content_type":"Note"}]}`)
+	if code == http.StatusAccepted {
+		t.Error("Sync should fail when the batch can't be saved")
+	}
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`)
+	if retrieved := res["retrieved_items"].([]interface{}); len(retrieved) != 0 {
+		t.Error("Failed batch should be rolled back:", retrieved)
+	}
+}
+
+func TestItemRevisions(t *testing.T) {
+	srv, token := registerMemoryUser(t)
+	handler := srv.Router().Serve().ServeHTTP
+
+	for _, content := range []string{"001abc", "002abc", "003abc"} {
+		request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-1","content":"`+content+`","content_type":"Note"}]}`)
+	}
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"tag-1","content":"001abc","content_type":"Tag"}]}`)
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"tag-1","content":"002abc","content_type":"Tag"}]}`)
+
+	r := httptest.NewRequest("GET", "/api/items/note-1/revisions", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	revisions := []map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &revisions); err != nil || w.Code != http.StatusOK {
+		t.Fatal("Unexpected revisions response:", w.Code, w.Body.String())
+	}
+	if len(revisions) != 2 || revisions[0]["content"] != nil {
+		t.Fatal("Previous versions should be listed without content:", revisions)
+	}
+
+	code, res := request(t, handler, "GET", "/api/items/note-1/revisions/"+revisions[0]["uuid"].(string), token, "")
+	if code != http.StatusOK || res["content"] != "002abc" || res["item_uuid"] != "note-1" {
+		t.Error("Unexpected revision:", code, res)
+	}
+
+	r = httptest.NewRequest("GET", "/api/items/tag-1/revisions", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Error("Revisions are kept for notes only by default:", w.Body.String())
+	}
+
+	other := registerUser(t, srv, "other@local")
+	code, _ = request(t, handler, "GET", "/api/items/note-1/revisions", other, "")
+	if code != http.StatusNotFound {
+		t.Error("Revisions of another user's item should not be found:", code)
+	}
+	code, _ = request(t, handler, "GET", "/api/items/note-1/revisions/"+revisions[0]["uuid"].(string), other, "")
+	if code != http.StatusNotFound {
+		t.Error("Revision of another user's item should not be found:", code)
+	}
+
+	r = httptest.NewRequest("GET", "/api/items/backup", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "note-1") {
+		t.Error("Backup should be served next to revisions:", w.Code, w.Body.String())
+	}
+
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-1","deleted":true}]}`)
+	r = httptest.NewRequest("GET", "/api/items/note-1/revisions", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	revisions = []map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &revisions); err != nil || len(revisions) != 3 {
+		t.Fatal("Deleting item should keep its last version:", w.Code, w.Body.String())
+	}
+	code, res = request(t, handler, "GET", "/api/items/note-1/revisions/"+revisions[0]["uuid"].(string), token, "")
+	if code != http.StatusOK || res["content"] != "003abc" {
+		t.Error("Unexpected last version of deleted item:", code, res)
+	}
+}
+
+func TestBackupItems(t *testing.T) {
+	srv, token := registerMemoryUser(t)
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-1","content":"001abc","content_type":"Note"},{"uuid":"tag-1","content":"001abc","content_type":"Tag"},{"uuid":"note-2","content":"001abc","content_type":"Note"}]}`)
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-2","deleted":true}]}`)
+
+	backup := func(query string) (*httptest.ResponseRecorder, []string) {
+		r := httptest.NewRequest("GET", "/api/items/backup"+query, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		srv.BackupItems(w, r)
+		result := struct {
+			Items      []sf.Item              `json:"items"`
+			AuthParams map[string]interface{} `json:"auth_params"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal("Invalid backup:", w.Code, w.Body.String())
+		}
+		if result.AuthParams["pw_nonce"] != "nonce" || result.AuthParams["version"] == nil {
+			t.Error("Backup should contain auth params:", result.AuthParams)
+		}
+		uuids := []string{}
+		for _, item := range result.Items {
+			uuids = append(uuids, item.UUID)
+		}
+		return w, uuids
+	}
+
+	w, uuids := backup("")
+	if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment;") {
+		t.Error("Backup should be served as download:", w.Header())
+	}
+	if strings.Join(uuids, ",") != "note-1,tag-1" {
+		t.Error("Backup should contain all items except deleted:", uuids)
+	}
+	if _, uuids = backup("?content_type=Tag"); strings.Join(uuids, ",") != "tag-1" {
+		t.Error("Backup should be filtered by content type:", uuids)
+	}
+	if _, uuids = backup("?deleted=true"); strings.Join(uuids, ",") != "note-2" {
+		t.Error("Backup should be filtered by deleted status:", uuids)
+	}
+
+	code, _ := request(t, srv.BackupItems, "GET", "/api/items/backup", "invalid", "")
+	if code != http.StatusUnauthorized {
+		t.Error("Backup with invalid token should fail:", code)
+	}
+}
+
+func TestImportItems(t *testing.T) {
+	srv, token := registerMemoryUser(t)
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-1","content":"001abc","content_type":"Note"}]}`)
+	backup := `{"auth_params":{"version":"003"},"items":[{"uuid":"note-1","content":"002abc","content_type":"Note"},{"uuid":"note-2","content":"002abc","content_type":"Note"},{"uuid":"note-3","deleted":true}]}`
+
+	code, res := request(t, srv.ImportItems, "POST", "/api/items/import", token, backup)
+	if code != http.StatusAccepted || len(res["saved_items"].([]interface{})) != 1 || len(res["skipped"].([]interface{})) != 2 {
+		t.Fatal("Existing and deleted items should be skipped:", code, res)
+	}
+
+	_, res = request(t, srv.ImportItems, "POST", "/api/items/import?on_conflict=overwrite", token, backup)
+	if len(res["saved_items"].([]interface{})) != 2 {
+		t.Error("Existing items should be overwritten:", res)
+	}
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`)
+	if retrieved := res["retrieved_items"].([]interface{}); len(retrieved) != 2 || retrieved[0].(map[string]interface{})["content"] != "002abc" {
+		t.Error("Unexpected items after overwrite:", retrieved)
+	}
+
+	// uuid of encrypted item is authenticated, copy under new uuid couldn't be decrypted
+	_, res = request(t, srv.ImportItems, "POST", "/api/items/import?on_conflict=duplicate", token, backup)
+	if unsaved := res["unsaved"].([]interface{}); len(unsaved) != 2 || len(res["saved_items"].([]interface{})) != 0 {
+		t.Error("Encrypted items should not be duplicated:", res)
+	}
+	plain := `{"items":[{"uuid":"note-1","content":"000eyJ0aXRsZSI6Im5vdGUifQ==","content_type":"Note"},{"uuid":"note-2","content":"000eyJ0aXRsZSI6Im5vdGUifQ==","content_type":"Note"}]}`
+	_, res = request(t, srv.ImportItems, "POST", "/api/items/import?on_conflict=duplicate", token, plain)
+	for _, item := range res["saved_items"].([]interface{}) {
+		if uuid := item.(map[string]interface{})["uuid"]; uuid == "note-1" || uuid == "note-2" {
+			t.Error("Duplicates should get new uuid:", uuid)
+		}
+	}
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`)
+	if retrieved := res["retrieved_items"].([]interface{}); len(retrieved) != 4 {
+		t.Error("Unexpected items after duplicate:", len(retrieved))
+	}
+
+	other := registerUser(t, srv, "other@local")
+	_, res = request(t, srv.ImportItems, "POST", "/api/items/import?on_conflict=overwrite", other, backup)
+	if unsaved := res["unsaved"].([]interface{}); len(unsaved) != 2 {
+		t.Error("Items of another user should not be overwritten:", res)
+	}
+
+	code, _ = request(t, srv.ImportItems, "POST", "/api/items/import?on_conflict=merge", token, backup)
+	if code != http.StatusUnprocessableEntity {
+		t.Error("Unknown conflict option should be rejected:", code)
+	}
+}
+
+func TestProtocol004(t *testing.T) {
+	srv := sf.NewServer(sf.NewMemoryStore())
+	code, res := request(t, srv.Registration, "POST", "/api/auth", "", `{"email":"new@local","password":"secret","pw_nonce":"nonce004","version":"004"}`)
+	if code != http.StatusCreated {
+		t.Fatal("Registration failed:", code, res)
+	}
+	_, res = request(t, srv.GetParams, "GET", "/api/auth/params?email=new@local", "", "")
+	if res["version"] != "004" || res["pw_nonce"] != "nonce004" || res["identifier"] != "new@local" || res["pw_cost"] != nil {
+		t.Error("Unexpected 004 params:", res)
+	}
+	code, _ = request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"new@local","password":"secret"}`)
+	if code != http.StatusAccepted {
+		t.Error("Login with 004 account failed:", code)
+	}
+
+	code, _ = request(t, srv.Registration, "POST", "/api/auth", "", `{"email":"bad@local","password":"secret","version":"004"}`)
+	if code != http.StatusUnprocessableEntity {
+		t.Error("004 registration without pw_nonce should fail:", code)
+	}
+	code, _ = request(t, srv.Registration, "POST", "/api/auth", "", `{"email":"bad@local","password":"secret","pw_nonce":"nonce","version":"005"}`)
+	if code != http.StatusUnprocessableEntity {
+		t.Error("Registration with unknown version should fail:", code)
+	}
+
+	token := registerUser(t, srv, "old@local")
+	_, res = request(t, srv.GetParams, "GET", "/api/auth/params?email=old@local", "", "")
+	if res["version"] != "003" || res["pw_cost"].(float64) != 110000 {
+		t.Error("Unexpected 003 params:", res)
+	}
+	code, res = request(t, srv.ChangePassword, "POST", "/api/auth/change_pw", token, `{"email":"old@local","current_password":"secret","new_password":"upgraded","pw_nonce":"nonce004","version":"004"}`)
+	if code != http.StatusAccepted {
+		t.Fatal("Protocol upgrade failed:", code, res)
+	}
+	_, res = request(t, srv.GetParams, "GET", "/api/auth/params?email=old@local", "", "")
+	if res["version"] != "004" || res["pw_nonce"] != "nonce004" || res["pw_salt"] != nil {
+		t.Error("Unexpected params after upgrade:", res)
+	}
+	code, _ = request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"old@local","password":"upgraded"}`)
+	if code != http.StatusAccepted {
+		t.Error("Login after upgrade failed:", code)
+	}
+}
+
+func status(handler http.HandlerFunc, method, url, token, body string) int {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func sessions(t *testing.T, srv *sf.Server, token string) []map[string]interface{} {
+	r := httptest.NewRequest("GET", "/api/sessions", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	srv.ListSessions(w, r)
+	list := []map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal("Invalid sessions response:", w.Code, w.Body.String())
+	}
+	return list
+}
+
+func TestSessions(t *testing.T) {
+	srv, legacy := registerMemoryUser(t)
+
+	code, res := request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret","api":"20200115"}`)
+	if code != http.StatusAccepted || res["session"] == nil {
+		t.Fatal("Login should return session tokens:", code, res)
+	}
+	session := res["session"].(map[string]interface{})
+	access, refresh := session["access_token"].(string), session["refresh_token"].(string)
+	if session["access_expiration"].(float64) <= float64(time.Now().Unix()*1000) {
+		t.Error("Access token should expire in future:", session)
+	}
+
+	list := sessions(t, srv, access)
+	if len(list) != 2 {
+		t.Fatal("Both sessions should be listed:", list)
+	}
+	var current, other string
+	for _, s := range list {
+		if s["current"] == true {
+			current = s["uuid"].(string)
+		} else {
+			other = s["uuid"].(string)
+		}
+	}
+	if current == "" || other == "" {
+		t.Fatal("Current session should be marked:", list)
+	}
+	if code := status(srv.RevokeSession, "DELETE", "/api/session", access, `{"uuid":"`+current+`"}`); code != http.StatusBadRequest {
+		t.Error("Current session should not be revoked:", code)
+	}
+	if code := status(srv.RevokeSession, "DELETE", "/api/session", access, `{"uuid":"`+other+`"}`); code != http.StatusNoContent {
+		t.Error("Session revoke failed:", code)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", legacy, `{"items":[]}`); code != http.StatusUnauthorized {
+		t.Error("Token of revoked session should be rejected:", code)
+	}
+
+	code, res = request(t, srv.RefreshSession, "POST", "/api/session/refresh", "", `{"access_token":"`+access+`","refresh_token":"`+refresh+`"}`)
+	if code != http.StatusOK {
+		t.Fatal("Refresh failed:", code, res)
+	}
+	rotated := res["session"].(map[string]interface{})
+	if rotated["refresh_token"] == refresh {
+		t.Error("Refresh token should be rotated")
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", rotated["access_token"].(string), `{"items":[]}`); code != http.StatusAccepted {
+		t.Error("Refreshed access token should be accepted:", code)
+	}
+	// reuse of rotated refresh token means it has leaked
+	if code := status(srv.RefreshSession, "POST", "/api/session/refresh", "", `{"access_token":"`+access+`","refresh_token":"`+refresh+`"}`); code != http.StatusUnauthorized {
+		t.Error("Used refresh token should be rejected:", code)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", rotated["access_token"].(string), `{"items":[]}`); code != http.StatusUnauthorized {
+		t.Error("Session should be revoked after refresh token reuse:", code)
+	}
+
+	tokens := []string{}
+	for i := 0; i < 3; i++ {
+		_, res = request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`)
+		tokens = append(tokens, res["token"].(string))
+	}
+	if code := status(srv.RevokeOtherSessions, "DELETE", "/api/session/all", tokens[0], ""); code != http.StatusNoContent {
+		t.Error("Revoking other sessions failed:", code)
+	}
+	if list := sessions(t, srv, tokens[0]); len(list) != 1 {
+		t.Error("Only current session should be left:", list)
+	}
+	if code := status(srv.SignOut, "POST", "/api/auth/sign_out", tokens[0], ""); code != http.StatusNoContent {
+		t.Error("Sign out failed:", code)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", tokens[0], `{"items":[]}`); code != http.StatusUnauthorized {
+		t.Error("Token should be rejected after sign out:", code)
+	}
+}
+
+func TestIdleLegacySession(t *testing.T) {
+	store := sf.NewMemoryStore()
+	srv := sf.NewServer(store)
+	idle := registerUser(t, srv, "mem@local")
+	code, res := request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`)
+	if code != http.StatusAccepted {
+		t.Fatal("Login failed:", code, res)
+	}
+	active := res["token"].(string)
+
+	user, err := store.UserByEmail("mem@local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.UserSessions(user.UUID)
+	if err != nil || len(list) != 2 {
+		t.Fatal("Both sessions should be stored:", list, err)
+	}
+	// the first session was created first, sessions are listed most recently used first
+	s := list[1]
+	s.UpdatedAt = time.Now().Add(-31 * 24 * time.Hour)
+	if err := store.UpdateSession(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", idle, `{"items":[]}`); code != http.StatusUnauthorized {
+		t.Error("Idle legacy session should be rejected:", code)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", active, `{"items":[]}`); code != http.StatusAccepted {
+		t.Error("Active legacy session should be accepted:", code)
+	}
+	if list, _ := store.UserSessions(user.UUID); len(list) != 1 {
+		t.Error("Idle session should be deleted:", list)
+	}
+}
+
+func TestPasswordHashing(t *testing.T) {
+	s := sf.NewMemoryStore()
+	srv := sf.NewServer(s)
+	legacy := fmt.Sprintf("%x", sha256.Sum256([]byte("secret")))
+	s.CreateUser(&sf.User{UUID: "legacy-user", Email: "legacy@local", Password: legacy, PwNonce: "nonce", CreatedAt: time.Now(), UpdatedAt: time.Now()})
+
+	code, res := request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"legacy@local","password":"wrong"}`)
+	if code != http.StatusUnauthorized {
+		t.Error("Login with wrong password should fail:", code)
+	}
+	code, res = request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"legacy@local","password":"secret"}`)
+	if code != http.StatusAccepted {
+		t.Fatal("Login with legacy password hash failed:", code, res)
+	}
+	user, _ := s.UserByEmail("legacy@local")
+	if user.Password == legacy || !strings.HasPrefix(user.Password, "$2") {
+		t.Error("Legacy password hash should be replaced with bcrypt:", user.Password)
+	}
+	code, _ = request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"legacy@local","password":"secret"}`)
+	if code != http.StatusAccepted {
+		t.Error("Login after rehash failed:", code)
+	}
+
+	token := res["token"].(string)
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	if strings.Contains(string(payload), "pw_hash") || strings.Contains(string(payload), legacy) {
+		t.Error("Token should not contain password hash:", string(payload))
+	}
+
+	code, _ = request(t, srv.ChangePassword, "POST", "/api/auth/change_pw", token, `{"email":"legacy@local","current_password":"wrong","new_password":"changed","pw_nonce":"nonce2"}`)
+	if code != http.StatusUnauthorized {
+		t.Error("Password change with wrong current password should fail:", code)
+	}
+	code, res = request(t, srv.ChangePassword, "POST", "/api/auth/change_pw", token, `{"email":"legacy@local","current_password":"secret","new_password":"changed","pw_nonce":"nonce2"}`)
+	if code != http.StatusAccepted {
+		t.Fatal("Password change failed:", code, res)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`); code != http.StatusUnauthorized {
+		t.Error("Token issued before password change should be rejected:", code)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", res["token"].(string), `{"items":[]}`); code != http.StatusAccepted {
+		t.Error("Token issued by password change should be accepted:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"legacy@local","password":"changed"}`); code != http.StatusAccepted {
+		t.Error("Login with new password failed:", code)
+	}
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestMFALegacySecret(t *testing.T) {
+	store := sf.NewMemoryStore()
+	srv := sf.NewServer(store)
+	token := registerUser(t, srv, "mem@local")
+	_, res := request(t, srv.StartMFA, "POST", "/api/mfa", token, "")
+	secret, key := res["secret"].(string), "mfa_"+res["uuid"].(string)
+	request(t, srv.EnableMFA, "POST", "/api/mfa/enable", token, `{"code":"`+totpCode(t, secret, time.Now())+`"}`)
+
+	// versions before key file encrypted secrets with key derived from the published signing key
+	published := "qA6irmDikU6RkCM4V0cJiUJEROuCsqTa1esexI4aWedSv405v8lw4g1KB1nQVsSdCrcyRlKFdws4XPlsArWwv9y5Xr5Jtkb11w1NxKZabOUa7mxjeENuCs31Y1Ce49XH9kGMPe0ms7iV7e9F6WgnsPFGOlIA3CwfGyr12okas2EsDd71SbSnA0zJYjyxeCVCZJWISmLB"
+	legacyKey := sha256.Sum256([]byte("standardfile data key:" + published))
+	block, _ := aes.NewCipher(legacyKey[:])
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	user, _ := store.UserByEmail("mem@local")
+	m, err := store.MFAByUser(user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Secret = base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil))
+	m.LastStep = 0
+	store.UpdateMFA(&m)
+
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret","`+key+`":"`+totpCode(t, secret, time.Now())+`"}`); code != http.StatusAccepted {
+		t.Fatal("Sign in with secret encrypted by legacy key failed:", code)
+	}
+	if converted, _ := store.MFAByUser(user.UUID); converted.Secret == m.Secret {
+		t.Error("Legacy secret should be re-encrypted with data key")
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret","`+key+`":"`+totpCode(t, secret, time.Now().Add(30*time.Second))+`"}`); code != http.StatusAccepted {
+		t.Error("Sign in with re-encrypted secret failed:", code)
+	}
+}
+
+func TestMFA(t *testing.T) {
+	srv, token := registerMemoryUser(t)
+
+	code, res := request(t, srv.StartMFA, "POST", "/api/mfa", token, "")
+	if code != http.StatusCreated {
+		t.Fatal("MFA setup failed:", code, res)
+	}
+	secret := res["secret"].(string)
+	key := "mfa_" + res["uuid"].(string)
+	if !strings.HasPrefix(res["otpauth_url"].(string), "otpauth://totp/") {
+		t.Error("Unexpected otpauth url:", res["otpauth_url"])
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`); code != http.StatusAccepted {
+		t.Error("Pending MFA should not be required on sign in:", code)
+	}
+
+	if code := status(srv.EnableMFA, "POST", "/api/mfa/enable", token, `{"code":"000000"}`); code != http.StatusBadRequest {
+		t.Error("MFA should not be enabled with wrong code:", code)
+	}
+	enableCode := totpCode(t, secret, time.Now())
+	code, res = request(t, srv.EnableMFA, "POST", "/api/mfa/enable", token, `{"code":"`+enableCode+`"}`)
+	if code != http.StatusOK {
+		t.Fatal("Enabling MFA failed:", code, res)
+	}
+	recovery := res["recovery_codes"].([]interface{})
+	if len(recovery) != 10 {
+		t.Error("Expected 10 recovery codes:", recovery)
+	}
+
+	code, res = request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`)
+	e, _ := res["error"].(map[string]interface{})
+	if code != http.StatusUnauthorized || e["tag"] != "mfa-required" || e["payload"].(map[string]interface{})["mfa_key"] != key {
+		t.Error("Sign in without code should require MFA:", code, res)
+	}
+	code, res = request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret","`+key+`":"000000"}`)
+	if e, _ := res["error"].(map[string]interface{}); code != http.StatusUnauthorized || e["tag"] != "mfa-invalid" {
+		t.Error("Sign in with wrong code should fail:", code, res)
+	}
+	// the code used to enable MFA was already spent
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret","`+key+`":"`+enableCode+`"}`); code != http.StatusUnauthorized {
+		t.Error("TOTP code should not be accepted twice:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret","`+key+`":"`+totpCode(t, secret, time.Now().Add(30*time.Second))+`"}`); code != http.StatusAccepted {
+		t.Error("Sign in with next TOTP code failed:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in?"+key+"="+recovery[0].(string), "", `{"email":"mem@local","password":"secret"}`); code != http.StatusAccepted {
+		t.Error("Sign in with recovery code failed:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret","`+key+`":"`+recovery[0].(string)+`"}`); code != http.StatusUnauthorized {
+		t.Error("Recovery code should be single use:", code)
+	}
+
+	if code := status(srv.DisableMFA, "DELETE", "/api/mfa", token, `{"code":"000000"}`); code != http.StatusBadRequest {
+		t.Error("MFA should not be disabled with wrong code:", code)
+	}
+	if code := status(srv.DisableMFA, "DELETE", "/api/mfa", token, `{"code":"`+recovery[1].(string)+`"}`); code != http.StatusNoContent {
+		t.Error("Disabling MFA failed:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`); code != http.StatusAccepted {
+		t.Error("Sign in after disabling MFA failed:", code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	srv := sf.NewServer(sf.NewMemoryStore())
+	registerUser(t, srv, "lock@local")
+
+	for i := 1; i < 5; i++ {
+		if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"lock@local","password":"wrong"}`); code != http.StatusUnauthorized {
+			t.Fatal("Failed attempt", i, "should not lock sign in:", code)
+		}
+	}
+	code, res := request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"lock@local","password":"wrong"}`)
+	e, _ := res["error"].(map[string]interface{})
+	if code != http.StatusTooManyRequests || e["tag"] != "too-many-attempts" || e["payload"].(map[string]interface{})["retry_after"].(float64) < 1 {
+		t.Error("Sign in should be locked after 5 failed attempts:", code, res)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"LOCK@local","password":"secret"}`); code != http.StatusTooManyRequests {
+		t.Error("Locked sign in should reject correct password:", code)
+	}
+	if code := status(srv.GetParams, "GET", "/api/auth/params?email=lock@local", "", ""); code != http.StatusTooManyRequests {
+		t.Error("Params of locked email should not be served:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"wrong"}`); code != http.StatusUnauthorized {
+		t.Error("Other emails should not be locked:", code)
+	}
+}
+
+func TestLockoutProxyHeaders(t *testing.T) {
+	srv := sf.NewServer(sf.NewMemoryStore())
+	registerUser(t, srv, "proxied@local")
+	if err := sf.UseTrustedProxies("127.0.0.1, 10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	signIn := func(remote, forwarded, email, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/auth/sign_in", strings.NewReader(`{"email":"`+email+`","password":"`+password+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Forwarded-For", forwarded)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		srv.Login(w, r)
+		return w
+	}
+
+	// rotating the header doesn't help a client connecting directly
+	for i := 0; i < 50; i++ {
+		signIn("203.0.113.9:4000", fmt.Sprintf("198.51.100.%d", i), fmt.Sprintf("user%d@local", i), "wrong")
+	}
+	if w := signIn("203.0.113.9:4000", "198.51.100.200", "next@local", "wrong"); w.Code != http.StatusTooManyRequests {
+		t.Error("IP should be locked regardless of X-Forwarded-For:", w.Code)
+	}
+
+	// behind trusted proxies the client is the last address added before them
+	w := signIn("127.0.0.1:4000", "6.6.6.6, 198.51.100.7, 10.0.0.2", "proxied@local", "secret")
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusAccepted {
+		t.Fatal("Sign in through proxy failed:", w.Code, w.Body.String())
+	}
+	ips := []string{}
+	for _, s := range sessions(t, srv, res["token"].(string)) {
+		ips = append(ips, s["ip"].(string))
+	}
+	sort.Strings(ips)
+	if strings.Join(ips, ",") != "192.0.2.1,198.51.100.7" {
+		t.Error("Unexpected client addresses:", ips)
+	}
+}
+
+func TestFakeParams(t *testing.T) {
+	srv := sf.NewServer(sf.NewMemoryStore())
+	code, res := request(t, srv.Registration, "POST", "/api/auth", "", `{"email":"new@local","password":"secret","pw_nonce":"`+strings.Repeat("ab", 32)+`","version":"004"}`)
+	if code != http.StatusCreated {
+		t.Fatal("Registration failed:", code, res)
+	}
+
+	code, real := request(t, srv.GetParams, "GET", "/api/auth/params?email=new@local", "", "")
+	if code != http.StatusOK {
+		t.Fatal("Params failed:", code, real)
+	}
+	code, fake := request(t, srv.GetParams, "GET", "/api/auth/params?email=nobody@local", "", "")
+	if code != http.StatusOK || fake["identifier"] != "nobody@local" || fake["version"] != "004" {
+		t.Error("Unknown email should get fake params:", code, fake)
+	}
+	if nonce, _ := fake["pw_nonce"].(string); len(nonce) != len(real["pw_nonce"].(string)) {
+		t.Error("Fake pw_nonce should look like a real one:", fake)
+	}
+	if len(fake) != len(real) {
+		t.Error("Fake params should have the same keys as real 004 params:", fake, real)
+	}
+	for key := range real {
+		if _, ok := fake[key]; !ok {
+			t.Error("Fake params miss", key, fake)
+		}
+	}
+	_, again := request(t, srv.GetParams, "GET", "/api/auth/params?email=nobody@local", "", "")
+	if fmt.Sprint(again) != fmt.Sprint(fake) {
+		t.Error("Fake params should be the same for every request:", fake, again)
+	}
+	_, other := request(t, srv.GetParams, "GET", "/api/auth/params?email=other@local", "", "")
+	if other["pw_nonce"] == fake["pw_nonce"] {
+		t.Error("Fake params should differ by email:", other)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	srv, token := registerMemoryUser(t)
+	other := registerUser(t, srv, "other@local")
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"delete-1","content":"001abc","content_type":"Note"}]}`)
+	request(t, srv.SyncItems, "POST", "/api/items/sync", other, `{"items":[{"uuid":"keep-1","content":"001abc","content_type":"Note"}]}`)
+
+	if code := status(srv.DeleteAccount, "DELETE", "/api/auth", token, `{"password":"wrong"}`); code != http.StatusUnauthorized {
+		t.Error("Account should not be deleted with wrong password:", code)
+	}
+	if code := status(srv.DeleteAccount, "DELETE", "/api/auth", token, `{"password":"secret"}`); code != http.StatusNoContent {
+		t.Fatal("Account deletion failed:", code)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`); code != http.StatusUnauthorized {
+		t.Error("Token of deleted user should be rejected:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`); code != http.StatusUnauthorized {
+		t.Error("Deleted user should not sign in:", code)
+	}
+	_, res := request(t, srv.SyncItems, "POST", "/api/items/sync", other, `{"items":[]}`)
+	if items := res["retrieved_items"].([]interface{}); len(items) != 1 {
+		t.Error("Items of other users should be kept:", items)
+	}
+	// email can be registered again
+	registerUser(t, srv, "mem@local")
+}
+
+func TestChangeEmail(t *testing.T) {
+	srv, token := registerMemoryUser(t)
+	registerUser(t, srv, "taken@local")
+
+	if code := status(srv.ChangeEmail, "POST", "/api/auth/change_email", token, `{"current_password":"wrong","new_email":"new@local","new_password":"changed","pw_nonce":"nonce2"}`); code != http.StatusUnauthorized {
+		t.Error("Email change with wrong password should fail:", code)
+	}
+	if code := status(srv.ChangeEmail, "POST", "/api/auth/change_email", token, `{"current_password":"secret","new_email":"taken@local","new_password":"changed","pw_nonce":"nonce2"}`); code != http.StatusConflict {
+		t.Error("Email of other account should be rejected:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`); code != http.StatusAccepted {
+		t.Error("Rejected email change should keep credentials:", code)
+	}
+
+	code, res := request(t, srv.ChangeEmail, "POST", "/api/auth/change_email", token, `{"current_password":"secret","new_email":"new@local","new_password":"changed","pw_nonce":"nonce2"}`)
+	if code != http.StatusAccepted || res["user"].(map[string]interface{})["email"] != "new@local" {
+		t.Fatal("Email change failed:", code, res)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`); code != http.StatusUnauthorized {
+		t.Error("Token issued before email change should be rejected:", code)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", res["token"].(string), `{"items":[]}`); code != http.StatusAccepted {
+		t.Error("Token issued by email change should be accepted:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`); code != http.StatusUnauthorized {
+		t.Error("Old email should not sign in:", code)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"new@local","password":"changed"}`); code != http.StatusAccepted {
+		t.Error("New email should sign in:", code)
+	}
+	_, params := request(t, srv.GetParams, "GET", "/api/auth/params?email=new@local", "", "")
+	if params["identifier"] != "new@local" || params["pw_nonce"] != "nonce2" {
+		t.Error("Unexpected params after email change:", params)
+	}
+}
+
+func TestInvites(t *testing.T) {
+	s := sf.NewMemoryStore()
+	srv := sf.NewServer(s)
+	sf.RequireInvites(true)
+	defer sf.RequireInvites(false)
+	s.CreateInvite(&sf.Invite{Code: "FAMILY", MaxUses: 1, CreatedAt: time.Now()})
+	s.CreateInvite(&sf.Invite{Code: "OLD", ExpiresAt: time.Now().Add(-time.Hour), CreatedAt: time.Now()})
+
+	for _, body := range []string{
+		`{"email":"a@local","password":"secret","pw_nonce":"nonce"}`,
+		`{"email":"a@local","password":"secret","pw_nonce":"nonce","invite":"WRONG"}`,
+		`{"email":"a@local","password":"secret","pw_nonce":"nonce","invite":"OLD"}`,
+	} {
+		if code := status(srv.Registration, "POST", "/api/auth", "", body); code != http.StatusUnprocessableEntity {
+			t.Error("Registration without valid invite should fail:", code, body)
+		}
+	}
+	if code := status(srv.Registration, "POST", "/api/auth", "", `{"email":"a@local","password":"secret","pw_nonce":"nonce","invite":"FAMILY"}`); code != http.StatusCreated {
+		t.Fatal("Registration with invite failed:", code)
+	}
+	if code := status(srv.Registration, "POST", "/api/auth", "", `{"email":"b@local","password":"secret","pw_nonce":"nonce","invite":"FAMILY"}`); code != http.StatusUnprocessableEntity {
+		t.Error("Used up invite should be rejected:", code)
+	}
+	if _, err := s.UserByEmail("b@local"); err == nil {
+		t.Error("User should not be created with used up invite")
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	s := sf.NewMemoryStore()
+	srv := sf.NewServer(s)
+	token := registerUser(t, srv, "mem@local")
+	user, _ := s.UserByEmail("mem@local")
+	if err := user.SetDisabled(s, true); err != nil {
+		t.Fatal(err)
+	}
+	if code := status(srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`); code != http.StatusUnauthorized {
+		t.Error("Token of disabled user should be rejected:", code)
+	}
+	code, res := request(t, srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`)
+	if code != http.StatusUnauthorized || !strings.Contains(fmt.Sprint(res), "disabled") {
+		t.Error("Disabled user should not sign in:", code, res)
+	}
+	if err := user.SetDisabled(s, false); err != nil {
+		t.Fatal(err)
+	}
+	if code := status(srv.Login, "POST", "/api/auth/sign_in", "", `{"email":"mem@local","password":"secret"}`); code != http.StatusAccepted {
+		t.Error("Enabled user should sign in:", code)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	srv, token := registerMemoryUser(t)
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-1","content":"001abc","content_type":"Note"}]}`)
+
+	if code := status(srv.CreateAPIToken, "POST", "/api/tokens", token, `{"name":"bot","scopes":["root"]}`); code != http.StatusUnprocessableEntity {
+		t.Error("Unknown scope should be rejected:", code)
+	}
+	code, res := request(t, srv.CreateAPIToken, "POST", "/api/tokens", token, `{"name":"backup bot","scopes":["backup","items:read"]}`)
+	if code != http.StatusCreated || !strings.HasPrefix(res["token"].(string), "sfat_") {
+		t.Fatal("Creating API token failed:", code, res)
+	}
+	bot := res["token"].(string)
+	botUUID := res["api_token"].(map[string]interface{})["uuid"].(string)
+
+	if code := status(srv.BackupItems, "GET", "/api/items/backup", bot, ""); code != http.StatusOK {
+		t.Error("Backup with backup scope failed:", code)
+	}
+	_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", bot, `{"items":[]}`)
+	if items := res["retrieved_items"].([]interface{}); len(items) != 1 {
+		t.Error("Sync with items:read scope should retrieve items:", res)
+	}
+	code, res = request(t, srv.SyncItems, "POST", "/api/items/sync", bot, `{"items":[{"uuid":"note-2","content":"001abc","content_type":"Note"}]}`)
+	if code != http.StatusForbidden || !strings.Contains(fmt.Sprint(res), "items:write") {
+		t.Error("Saving items without items:write scope should be forbidden:", code, res)
+	}
+	for _, handler := range []http.HandlerFunc{srv.ListAPITokens, srv.ListSessions, srv.StartMFA} {
+		if code := status(handler, "GET", "/", bot, ""); code == http.StatusOK || code == http.StatusCreated {
+			t.Error("API token should not manage the account:", code)
+		}
+	}
+	if code := status(srv.ChangePassword, "POST", "/api/auth/change_pw", bot, `{"current_password":"secret","new_password":"x"}`); code != http.StatusUnauthorized && code != http.StatusForbidden {
+		t.Error("API token should not change password:", code)
+	}
+
+	code, res = request(t, srv.CreateAPIToken, "POST", "/api/tokens", token, `{"name":"expired","scopes":["items:read"],"expires_at":"2001-01-01T00:00:00Z"}`)
+	if code != http.StatusUnprocessableEntity {
+		t.Error("Token expiring in the past should be rejected:", code, res)
+	}
+
+	r := httptest.NewRequest("GET", "/api/tokens", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	srv.ListAPITokens(w, r)
+	tokens := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &tokens)
+	if len(tokens) != 1 || tokens[0]["name"] != "backup bot" || tokens[0]["token_hash"] != nil || strings.Contains(w.Body.String(), bot) {
+		t.Error("Unexpected tokens:", w.Body.String())
+	}
+
+	if code := status(srv.RevokeAPIToken, "DELETE", "/api/tokens", token, `{"uuid":"`+botUUID+`"}`); code != http.StatusNoContent {
+		t.Error("Revoking API token failed:", code)
+	}
+	if code := status(srv.BackupItems, "GET", "/api/items/backup", bot, ""); code != http.StatusUnauthorized {
+		t.Error("Revoked API token should be rejected:", code)
+	}
+}
+
+func TestScheduledBackups(t *testing.T) {
+	store := sf.NewMemoryStore()
+	srv := sf.NewServer(store)
+	token := registerUser(t, srv, "mem@local")
+	other := registerUser(t, srv, "other@local")
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-1","content":"001abc","content_type":"Note"}]}`)
+	dir := t.TempDir()
+	target := sf.NewDirTarget(dir)
+
+	// default retention keeps 7 daily and 4 weekly backups
+	day := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 40; i++ {
+		if err := sf.RunBackups(store, target, day.AddDate(0, 0, i)); err != nil {
+			t.Fatal("Backup failed:", err)
+		}
+	}
+	names, err := target.List("users/")
+	if err != nil || len(names) != 18 {
+		t.Fatal("Unexpected backups:", names, err)
+	}
+	dates := []string{}
+	for _, name := range names[:9] {
+		dates = append(dates, strings.TrimSuffix(filepath.Base(name), ".json"))
+	}
+	if strings.Join(dates, ",") != "2026-01-25,2026-02-01,2026-02-03,2026-02-04,2026-02-05,2026-02-06,2026-02-07,2026-02-08,2026-02-09" {
+		t.Error("Unexpected retention:", dates)
+	}
+
+	items := 0
+	for _, name := range []string{names[8], names[17]} {
+		backup := struct {
+			Items      []sf.Item              `json:"items"`
+			AuthParams map[string]interface{} `json:"auth_params"`
+		}{}
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || json.Unmarshal(content, &backup) != nil || backup.AuthParams["identifier"] == nil {
+			t.Error("Backup should be in Standard Notes format:", string(content), err)
+		}
+		items += len(backup.Items)
+	}
+	if items != 1 {
+		t.Error("Backups should contain items of each user:", items)
+	}
+
+	if code := status(srv.DeleteAccount, "DELETE", "/api/auth", other, `{"password":"secret"}`); code != http.StatusNoContent {
+		t.Fatal("Account deletion failed:", code)
+	}
+	sf.RunBackups(store, target, day.AddDate(0, 0, 40))
+	// a user missing from the database may be a lost or replaced database, not only deletion
+	if after, _ := target.List("users/"); len(after) != 18 || !strings.Contains(strings.Join(after, ","), names[17]) {
+		t.Error("Backups of deleted user should be kept by retention:", after)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//minPartSize - S3 rejects multipart uploads with smaller parts, except the last one
+const minPartSize = 5 << 20
+
+//S3Config - S3 compatible storage backups are uploaded to
+type S3Config struct {
+	// Endpoint is the URL of the service, e.g. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PartSize in bytes, larger backups are sent with multipart upload
+	PartSize int
+}
+
+//s3Target - backups stored as objects, bucket is addressed by path so it works with MinIO and other services
+type s3Target struct {
+	S3Config
+	client *http.Client
+}
+
+//NewS3Target - target uploading backups to the bucket, names are prefixed with Prefix
+func NewS3Target(c S3Config) (BackupTarget, error) {
+	if c.Endpoint == "" || c.Bucket == "" {
+		return nil, fmt.Errorf("S3 endpoint and bucket are required")
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return nil, fmt.Errorf("S3 access key and secret key are required")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.PartSize <= 0 {
+		c.PartSize = 8 << 20
+	}
+	if c.Prefix != "" && !strings.HasSuffix(c.Prefix, "/") {
+		c.Prefix += "/"
+	}
+	c.Endpoint = strings.TrimRight(c.Endpoint, "/")
+	return &s3Target{S3Config: c, client: &http.Client{Timeout: 10 * time.Minute}}, nil
+}
+
+//s3Error - error response of the service
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+//Put - content smaller than PartSize is uploaded with single request, larger one in parts
+func (t *s3Target) Put(name string, write func(w io.Writer) error) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(write(w))
+	}()
+	// stops the writer when upload fails
+	defer r.Close()
+
+	key := t.Prefix + name
+	part := make([]byte, t.PartSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = t.do("PUT", key, nil, part[:n])
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	upload := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	res, err := t.do("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(res, &upload); err != nil {
+		return err
+	}
+	if err := t.uploadParts(key, upload.UploadID, r, part, n); err != nil {
+		if _, abortErr := t.do("DELETE", key, url.Values{"uploadId": {upload.UploadID}}, nil); abortErr != nil {
+			Log("Aborting upload of", key, "failed:", abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+//completedPart - part of multipart upload identified by its ETag
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+//uploadParts - sends first n bytes of part and the rest of r, then completes the upload
+func (t *s3Target) uploadParts(key, uploadID string, r io.Reader, part []byte, n int) error {
+	parts := []completedPart{}
+	for number := 1; n > 0; number++ {
+		etag, err := t.uploadPart(key, uploadID, number, part[:n])
+		if err != nil {
+			return err
+		}
+		parts = append(parts, completedPart{number, etag})
+		n, err = io.ReadFull(r, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	}
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	res, err := t.do("POST", key, url.Values{"uploadId": {uploadID}}, complete)
+	if err != nil {
+		return err
+	}
+	// the service may fail after it started responding with 200
+	if e := (s3Error{}); xml.Unmarshal(res, &e) == nil && e.Code != "" {
+		return fmt.Errorf("S3 upload of %s failed: %s %s", key, e.Code, e.Message)
+	}
+	return nil
+}
+
+func (t *s3Target) uploadPart(key, uploadID string, number int, content []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	req, err := t.request("PUT", key, query, content)
+	if err != nil {
+		return "", err
+	}
+	res, err := t.send(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return res.Header.Get("ETag"), nil
+}
+
+//List - lists objects page by page
+func (t *s3Target) List(prefix string) ([]string, error) {
+	names := []string{}
+	query := url.Values{"list-type": {"2"}, "prefix": {t.Prefix + prefix}}
+	for {
+		res, err := t.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		list := struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}{}
+		if err := xml.Unmarshal(res, &list); err != nil {
+			return nil, err
+		}
+		for _, object := range list.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, t.Prefix))
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (t *s3Target) Delete(name string) error {
+	_, err := t.do("DELETE", t.Prefix+name, nil, nil)
+	return err
+}
+
+//do - sends signed request and returns response body
+func (t *s3Target) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	req, err := t.request(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+func (t *s3Target) send(req *http.Request) (*http.Response, error) {
+	res, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		e := s3Error{}
+		content, _ := ioutil.ReadAll(res.Body)
+		if xml.Unmarshal(content, &e) != nil || e.Code == "" {
+			e.Code = res.Status
+		}
+		return nil, fmt.Errorf("S3 %s %s failed: %s %s", req.Method, req.URL.Path, e.Code, e.Message)
+	}
+	return res, nil
+}
+
+//request - request to object key of the bucket (or the bucket itself for empty key) signed with AWS signature version 4
+func (t *s3Target) request(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	path := "/" + t.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u := t.Endpoint + s3Escape(path, false)
+	if q := s3Query(query); q != "" {
+		u += "?" + q
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	t.sign(req, body, time.Now().UTC())
+	return req, nil
+}
+
+//sign - adds authorization header, see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (t *s3Target) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date:" + req.Header.Get("X-Amz-Date"),
+		"",
+		strings.Join(headers, ";"),
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := now.Format("20060102") + "/" + t.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + t.SecretKey)
+	for _, part := range []string{now.Format("20060102"), t.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+t.AccessKey+"/"+scope+", SignedHeaders="+strings.Join(headers, ";")+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//s3Escape - URI encoding required by the signature, slash is kept in paths
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+//s3Query - canonical query string, sorted by name
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := []string{}
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
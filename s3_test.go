@@ -0,0 +1,187 @@
+package main_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sf "github.com/tectiv3/standardfile"
+)
+
+//fakeS3 - in memory bucket speaking the part of S3 API used by backups
+type fakeS3 struct {
+	sync.Mutex
+	bucket    string
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte
+	multipart int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (s *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") || r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		s.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != s.bucket {
+		s.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	if len(parts) == 1 {
+		s.list(w, query.Get("prefix"), query.Get("continuation-token"))
+		return
+	}
+	key := parts[1]
+	switch {
+	case r.Method == "POST" && query["uploads"] != nil:
+		id := strconv.Itoa(len(s.uploads) + 1)
+		s.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		s.uploads[query.Get("uploadId")][number] = body
+		w.Header().Set("ETag", `"part-`+query.Get("partNumber")+`"`)
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		complete := struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}{}
+		xml.Unmarshal(body, &complete)
+		content := []byte{}
+		for _, part := range complete.Parts {
+			if part.ETag != `"part-`+strconv.Itoa(part.PartNumber)+`"` {
+				s.fail(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			content = append(content, s.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		s.objects[key] = content
+		s.multipart++
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "PUT":
+		s.objects[key] = body
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+//list - returns two keys per page, so clients have to follow continuation tokens
+func (s *fakeS3) list(w http.ResponseWriter, prefix, after string) {
+	keys := []string{}
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	truncated := len(keys) > 2
+	if truncated {
+		keys = keys[:2]
+	}
+	fmt.Fprint(w, "<ListBucketResult>")
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", key)
+	}
+	if truncated {
+		fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", keys[1])
+	}
+	fmt.Fprintf(w, "<IsTruncated>%t</IsTruncated></ListBucketResult>", truncated)
+}
+
+func TestS3Backups(t *testing.T) {
+	store := sf.NewMemoryStore()
+	srv := sf.NewServer(store)
+	token := registerUser(t, srv, "mem@local")
+	other := registerUser(t, srv, "other@local")
+	content := strings.Repeat("a", 3000)
+	request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"note-1","content":"`+content+`","content_type":"Note"}]}`)
+
+	s3 := newFakeS3("backups")
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	if _, err := sf.NewS3Target(sf.S3Config{Endpoint: server.URL, Bucket: "backups"}); err == nil {
+		t.Error("Target without credentials should be rejected")
+	}
+	wrong, _ := sf.NewS3Target(sf.S3Config{Endpoint: server.URL, Bucket: "missing", AccessKey: "access", SecretKey: "secret"})
+	if err := sf.RunBackups(store, wrong, time.Now()); err == nil || !strings.Contains(err.Error(), "NoSuchBucket") {
+		t.Error("Error of the service should be returned:", err)
+	}
+
+	target, err := sf.NewS3Target(sf.S3Config{Endpoint: server.URL, Bucket: "backups", Prefix: "sf", AccessKey: "access", SecretKey: "secret", PartSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		if err := sf.RunBackups(store, target, day.AddDate(0, 0, i)); err != nil {
+			t.Fatal("Backup failed:", err)
+		}
+	}
+	if s3.multipart != 10 {
+		t.Error("Large backups should be uploaded in parts:", s3.multipart)
+	}
+	names, err := target.List("users/")
+	// 7 daily and 1 more weekly backup for each user
+	if err != nil || len(names) != 16 {
+		t.Fatal("Unexpected backups:", names, err)
+	}
+	for key := range s3.objects {
+		if !strings.HasPrefix(key, "sf/users/") {
+			t.Error("Backups should be stored under prefix:", key)
+		}
+	}
+
+	items := 0
+	for _, name := range names {
+		backup := struct {
+			Items []sf.Item `json:"items"`
+		}{}
+		if err := json.Unmarshal(s3.objects["sf/"+name], &backup); err != nil {
+			t.Fatal("Invalid backup:", name, err)
+		}
+		items += len(backup.Items)
+		if len(backup.Items) == 1 && backup.Items[0].Content != content {
+			t.Error("Backup content should be complete")
+		}
+	}
+	if items != 8 {
+		t.Error("Backups should contain items of each user:", items)
+	}
+
+	status(srv.DeleteAccount, "DELETE", "/api/auth", other, `{"password":"secret"}`)
+	sf.RunBackups(store, target, day.AddDate(0, 0, 10))
+	if names, _ = target.List(""); len(names) != 16 {
+		t.Error("Backups of deleted user should be kept by retention:", names)
+	}
+}
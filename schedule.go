@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tectiv3/standardfile/db"
+)
+
+//userBackups - prefix of per-user backups in the target, files are named users/<uuid>/<date>.json
+const userBackups = "users/"
+
+//dbBackups - prefix of database snapshots, named db/<date>.db
+const dbBackups = "db/"
+
+const backupDate = "2006-01-02"
+
+//backupSchedule - time of day backups run at, every night or on Sundays
+type backupSchedule struct {
+	weekly bool
+	hour   int
+	minute int
+}
+
+//parseBackupSchedule - "nightly" or "weekly", optionally followed by time, e.g. "weekly 04:30"
+func parseBackupSchedule(s string) (backupSchedule, error) {
+	schedule := backupSchedule{hour: 3}
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return schedule, fmt.Errorf("Invalid backup schedule: %q", s)
+	}
+	switch fields[0] {
+	case "nightly", "daily":
+	case "weekly":
+		schedule.weekly = true
+	default:
+		return schedule, fmt.Errorf("Invalid backup schedule: %q, use nightly or weekly", s)
+	}
+	if len(fields) == 2 {
+		t, err := time.Parse("15:04", fields[1])
+		if err != nil {
+			return schedule, fmt.Errorf("Invalid backup time: %q", fields[1])
+		}
+		schedule.hour, schedule.minute = t.Hour(), t.Minute()
+	}
+	return schedule, nil
+}
+
+//next - first scheduled time after now
+func (s backupSchedule) next(now time.Time) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), s.hour, s.minute, 0, 0, now.Location())
+	for !next.After(now) || (s.weekly && next.Weekday() != time.Sunday) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+//parseBackupKeep - retention configured as "daily:7,weekly:4"
+func parseBackupKeep(s string) (daily, weekly int, err error) {
+	for _, rule := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(rule), ":", 2)
+		if len(parts) != 2 {
+			return 0, 0, fmt.Errorf("Invalid backup retention: %q", rule)
+		}
+		keep, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || keep < 0 {
+			return 0, 0, fmt.Errorf("Invalid backup retention: %q", rule)
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "daily":
+			daily = keep
+		case "weekly":
+			weekly = keep
+		default:
+			return 0, 0, fmt.Errorf("Invalid backup retention: %q, use daily and weekly", rule)
+		}
+	}
+	return daily, weekly, nil
+}
+
+//expired - backups outside retention. Newest daily ones are kept, plus the newest one of each of the last weekly weeks
+func expired(names []string, daily, weekly int) []string {
+	dates := map[string]time.Time{}
+	dated := []string{}
+	for _, name := range names {
+		date, err := time.Parse(backupDate, strings.TrimSuffix(path.Base(name), path.Ext(name)))
+		if err != nil {
+			// not written by us, leave it alone
+			continue
+		}
+		dates[name] = date
+		dated = append(dated, name)
+	}
+	sort.Slice(dated, func(i, j int) bool { return dates[dated[i]].After(dates[dated[j]]) })
+
+	keep := map[string]bool{}
+	for i := 0; i < daily && i < len(dated); i++ {
+		keep[dated[i]] = true
+	}
+	weeks := map[string]bool{}
+	for _, name := range dated {
+		if len(weeks) >= weekly {
+			break
+		}
+		year, week := dates[name].ISOWeek()
+		if key := fmt.Sprint(year, week); !weeks[key] {
+			weeks[key] = true
+			keep[name] = true
+		}
+	}
+	result := []string{}
+	for _, name := range dated {
+		if !keep[name] {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+//RunBackups - writes backup file of every user and snapshot of sqlite database to the target,
+//then removes backups outside retention. Backups of deleted users are kept by the same retention,
+//so empty or replaced database doesn't wipe them
+func RunBackups(store Store, target BackupTarget, now time.Time) error {
+	daily, weekly, err := parseBackupKeep(cfg.BackupKeep)
+	if err != nil {
+		return err
+	}
+	users, err := store.Users()
+	if err != nil {
+		return err
+	}
+	var failed error
+	for _, u := range users {
+		name := userBackups + u.UUID + "/" + now.Format(backupDate) + ".json"
+		err := target.Put(name, func(w io.Writer) error {
+			return u.WriteBackup(store, w, itemFilter{})
+		})
+		if err != nil {
+			log.Println("Backup of", u.Email, "failed:", err)
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+	if err := snapshot(store, target, dbBackups+now.Format(backupDate)+".db"); err != nil {
+		log.Println("Database snapshot failed:", err)
+		if failed == nil {
+			failed = err
+		}
+	}
+
+	names, err := target.List("")
+	if err != nil {
+		return err
+	}
+	byDir := map[string][]string{}
+	for _, name := range names {
+		byDir[path.Dir(name)] = append(byDir[path.Dir(name)], name)
+	}
+	for _, names := range byDir {
+		for _, name := range expired(names, daily, weekly) {
+			if err := target.Delete(name); err != nil {
+				log.Println("Removing backup", name, "failed:", err)
+			}
+		}
+	}
+	return failed
+}
+
+//snapshot - copies database to the target, skipped for stores without snapshots
+func snapshot(store Store, target BackupTarget, name string) error {
+	err := withSnapshot(store, func(f *os.File) error {
+		return target.Put(name, func(w io.Writer) error {
+			_, err := io.Copy(w, f)
+			return err
+		})
+	})
+	if err == db.ErrNoSnapshot {
+		Log(err)
+		return nil
+	}
+	return err
+}
+
+//backupTarget - S3 bucket when s3_bucket is set, otherwise backup_dir. Nil when backups aren't configured
+func backupTarget() (BackupTarget, error) {
+	if cfg.S3Bucket != "" {
+		if cfg.S3PartSize<<20 < minPartSize {
+			return nil, fmt.Errorf("s3_part_size is in MB and must be at least 5")
+		}
+		return NewS3Target(S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			Prefix:    cfg.S3Prefix,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PartSize:  cfg.S3PartSize << 20,
+		})
+	}
+	if cfg.BackupDir != "" {
+		return NewDirTarget(cfg.BackupDir), nil
+	}
+	return nil, nil
+}
+
+//backupLocation - where backups are written, for logs
+func backupLocation() string {
+	if cfg.S3Bucket != "" {
+		return "s3://" + cfg.S3Bucket + "/" + cfg.S3Prefix
+	}
+	return cfg.BackupDir
+}
+
+//startBackups - schedules backups when backup_dir or s3_bucket is configured
+func startBackups(store Store) error {
+	target, err := backupTarget()
+	if target == nil || err != nil {
+		return err
+	}
+	schedule, err := parseBackupSchedule(cfg.BackupAt)
+	if err != nil {
+		return err
+	}
+	if _, _, err := parseBackupKeep(cfg.BackupKeep); err != nil {
+		return err
+	}
+	log.Println("Backups scheduled", cfg.BackupAt, "to", backupLocation())
+	go runScheduled(schedule, "backups", func(now time.Time) error {
+		return RunBackups(store, target, now)
+	})
+	return nil
+}
+
+//runScheduled - runs fn at scheduled times until the server stops
+func runScheduled(schedule backupSchedule, name string, fn func(now time.Time) error) {
+	for {
+		time.Sleep(time.Until(schedule.next(time.Now())))
+		log.Println("Running scheduled", name)
+		if err := fn(time.Now()); err != nil {
+			log.Println("Scheduled", name, "failed:", err)
+		}
+	}
+}
+
+//backupCommand - backup run|list
+func backupCommand(store Store, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: backup run|list")
+	}
+	target, err := backupTarget()
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return fmt.Errorf("Neither backup_dir nor s3_bucket is configured")
+	}
+	switch args[0] {
+	case "run":
+		if err := RunBackups(store, target, time.Now()); err != nil {
+			return err
+		}
+		log.Println("Backups written to", backupLocation())
+		return nil
+	case "list":
+		names, err := target.List("")
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown backup command: %s", args[0])
+}
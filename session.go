@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/satori/go.uuid"
+)
+
+//sessionsAPI - first API version with expiring access tokens and refresh tokens
+const sessionsAPI = "20200115"
+
+//seenInterval - last seen time of the session is updated at most once per interval
+const seenInterval = time.Minute
+
+//Session - signed in device of the user
+type Session struct {
+	UUID             string    `json:"uuid"`
+	UserUUID         string    `json:"-"           sql:"user_uuid"`
+	API              string    `json:"api_version" sql:"api"`
+	UserAgent        string    `json:"user_agent"  sql:"user_agent"`
+	Device           string    `json:"device_info" sql:"device"`
+	IP               string    `json:"ip"          sql:"ip"`
+	RefreshHash      string    `json:"-"           sql:"refresh_hash"`
+	RefreshExpiresAt time.Time `json:"-"           sql:"refresh_expires_at"`
+	CreatedAt        time.Time `json:"created_at"  sql:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"  sql:"updated_at"`
+}
+
+//Sessions - array of sessions
+type Sessions []Session
+
+//Client - describes device signing in
+type Client struct {
+	API       string
+	UserAgent string
+	IP        string
+}
+
+//SessionTokens - tokens of the session, expirations are in milliseconds as expected by SN clients
+type SessionTokens struct {
+	AccessToken       string `json:"access_token"`
+	RefreshToken      string `json:"refresh_token,omitempty"`
+	AccessExpiration  int64  `json:"access_expiration,omitempty"`
+	RefreshExpiration int64  `json:"refresh_expiration,omitempty"`
+}
+
+//usesRefresh - legacy clients don't refresh tokens, their access tokens have no expiration
+func (s Session) usesRefresh() bool {
+	return s.RefreshHash != ""
+}
+
+//idle - legacy session unused for longer than legacy_idle_ttl, its access token is no longer accepted
+func (s Session) idle() bool {
+	return !s.usesRefresh() && time.Since(s.UpdatedAt) > ttl(cfg.IdleTTL, 720*time.Hour)
+}
+
+//ToJSON - session as listed to the user
+func (s Session) ToJSON(current bool) interface{} {
+	return data{
+		"uuid":        s.UUID,
+		"api_version": s.API,
+		"user_agent":  s.UserAgent,
+		"device_info": s.Device,
+		"ip":          s.IP,
+		"current":     current,
+		"created_at":  s.CreatedAt,
+		"updated_at":  s.UpdatedAt,
+	}
+}
+
+//startSession - creates session for the client and issues its tokens
+func (u User) startSession(store Store, client Client) (SessionTokens, error) {
+	s := Session{
+		UUID:      uuid.Must(uuid.NewV4()).String(),
+		UserUUID:  u.UUID,
+		API:       client.API,
+		UserAgent: client.UserAgent,
+		Device:    describeDevice(client.UserAgent),
+		IP:        client.IP,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	refreshToken := ""
+	if client.API >= sessionsAPI {
+		refreshToken = newRefreshToken()
+		s.RefreshHash = hashToken(refreshToken)
+		s.RefreshExpiresAt = time.Now().Add(ttl(cfg.RefreshTTL, 60*24*time.Hour))
+	}
+	if err := store.CreateSession(&s); err != nil {
+		return SessionTokens{}, err
+	}
+	return u.sessionTokens(s, refreshToken)
+}
+
+//sessionTokens - signs access token bound to the session
+func (u User) sessionTokens(s Session, refreshToken string) (SessionTokens, error) {
+	claims := UserClaims{
+		UUID:      u.UUID,
+		SessionID: s.UUID,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt: time.Now().Unix(),
+		},
+	}
+	tokens := SessionTokens{RefreshToken: refreshToken}
+	if s.usesRefresh() {
+		expiresAt := time.Now().Add(ttl(cfg.AccessTTL, time.Hour))
+		claims.ExpiresAt = expiresAt.Unix()
+		tokens.AccessExpiration = expiresAt.UnixNano() / int64(time.Millisecond)
+		tokens.RefreshExpiration = s.RefreshExpiresAt.UnixNano() / int64(time.Millisecond)
+	}
+
+	tokenString, err := keys.sign(claims)
+	if err != nil {
+		return SessionTokens{}, err
+	}
+	tokens.AccessToken = tokenString
+	return tokens, nil
+}
+
+//refreshSession - issues new tokens for the session of access token, which may be expired already.
+//Refresh token is rotated, the session is revoked when an already used refresh token is presented
+func refreshSession(store Store, accessToken, refreshToken string, client Client) (SessionTokens, error) {
+	claims, err := parseToken(accessToken)
+	if err != nil {
+		if e, ok := err.(*jwt.ValidationError); !ok || e.Errors != jwt.ValidationErrorExpired {
+			return SessionTokens{}, fmt.Errorf("Invalid token")
+		}
+	}
+	user := NewUser()
+	if !user.LoadByUUID(store, claims.UUID) {
+		return SessionTokens{}, fmt.Errorf("Invalid token")
+	}
+	s, err := store.SessionByUUID(user.UUID, claims.SessionID)
+	if err != nil || !s.usesRefresh() {
+		return SessionTokens{}, fmt.Errorf("Invalid session")
+	}
+	if subtle.ConstantTimeCompare([]byte(s.RefreshHash), []byte(hashToken(refreshToken))) != 1 {
+		log.Println("Refresh token reused, revoking session", s.UUID)
+		store.DeleteSession(user.UUID, s.UUID)
+		return SessionTokens{}, fmt.Errorf("Invalid refresh token")
+	}
+	if time.Now().After(s.RefreshExpiresAt) {
+		return SessionTokens{}, fmt.Errorf("Refresh token expired")
+	}
+
+	refreshToken = newRefreshToken()
+	s.RefreshHash = hashToken(refreshToken)
+	s.RefreshExpiresAt = time.Now().Add(ttl(cfg.RefreshTTL, 60*24*time.Hour))
+	s.seenBy(client)
+	if err := store.UpdateSession(&s); err != nil {
+		return SessionTokens{}, err
+	}
+	return user.sessionTokens(s, refreshToken)
+}
+
+//touch - records last seen time of the session
+func (s *Session) touch(store Store, client Client) error {
+	if time.Since(s.UpdatedAt) < seenInterval {
+		return nil
+	}
+	s.seenBy(client)
+	return store.UpdateSession(s)
+}
+
+func (s *Session) seenBy(client Client) {
+	if client.IP != "" {
+		s.IP = client.IP
+	}
+	s.UpdatedAt = time.Now()
+}
+
+//GetSessions - active sessions of the user, most recently used first
+func (u User) GetSessions(store Store) (Sessions, error) {
+	return store.UserSessions(u.UUID)
+}
+
+//RevokeSession - signs out one of the user's sessions
+func (u User) RevokeSession(store Store, uuid string) error {
+	return store.DeleteSession(u.UUID, uuid)
+}
+
+//RevokeOtherSessions - signs out all sessions of the user except given one
+func (u User) RevokeOtherSessions(store Store, current string) error {
+	return store.DeleteUserSessions(u.UUID, current)
+}
+
+func newRefreshToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//hashToken - refresh tokens are stored hashed, a database leak doesn't allow to refresh sessions
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//ttl - parses duration from config, falls back to default if it's empty or invalid
+func ttl(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Println("Invalid token ttl:", value)
+		return fallback
+	}
+	return d
+}
+
+//describeDevice - short description of the client platform for sessions list
+func describeDevice(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	app := ""
+	switch {
+	case strings.Contains(ua, "electron") || strings.Contains(ua, "standard notes"):
+		app = "Standard Notes Desktop"
+	case strings.Contains(ua, "edg/"):
+		app = "Edge"
+	case strings.Contains(ua, "firefox"):
+		app = "Firefox"
+	case strings.Contains(ua, "chrome"):
+		app = "Chrome"
+	case strings.Contains(ua, "safari"):
+		app = "Safari"
+	case strings.Contains(ua, "okhttp"), strings.Contains(ua, "cfnetwork"):
+		app = "Standard Notes Mobile"
+	}
+	platform := ""
+	switch {
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ios"), strings.Contains(ua, "cfnetwork"):
+		platform = "iOS"
+	case strings.Contains(ua, "android"), strings.Contains(ua, "okhttp"):
+		platform = "Android"
+	case strings.Contains(ua, "windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "mac os"), strings.Contains(ua, "macintosh"):
+		platform = "macOS"
+	case strings.Contains(ua, "linux"):
+		platform = "Linux"
+	}
+	switch {
+	case app != "" && platform != "":
+		return app + " on " + platform
+	case app != "":
+		return app
+	case platform != "":
+		return platform
+	}
+	return "Unknown device"
+}
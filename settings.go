@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+//Settings - email notifications the user wants to receive
+type Settings struct {
+	UserUUID     string    `json:"-"              sql:"user_uuid"`
+	EmailBackups bool      `json:"email_backups"  sql:"email_backups"`
+	SignInAlerts bool      `json:"sign_in_alerts" sql:"sign_in_alerts"`
+	UpdatedAt    time.Time `json:"updated_at"     sql:"updated_at"`
+}
+
+//GetSettings - saved settings of the user, sign in alerts are on by default
+func (u User) GetSettings(store Store) (Settings, error) {
+	settings, err := store.UserSettings(u.UUID)
+	if err == errNotFound {
+		return Settings{UserUUID: u.UUID, SignInAlerts: true}, nil
+	}
+	return settings, err
+}
+
+//SaveSettings - stores settings of the user
+func (u User) SaveSettings(store Store, settings Settings) error {
+	settings.UserUUID = u.UUID
+	settings.UpdatedAt = time.Now()
+	return store.SaveSettings(&settings)
+}
+
+//notifySignIn - mails the user about sign in from device none of their sessions uses.
+//Must be called before the new session is created
+func (u User) notifySignIn(store Store, client Client) {
+	m := mailer
+	if m == nil {
+		return
+	}
+	settings, err := u.GetSettings(store)
+	if err != nil || !settings.SignInAlerts {
+		return
+	}
+	sessions, err := store.UserSessions(u.UUID)
+	if err != nil {
+		Log(err)
+		return
+	}
+	device := describeDevice(client.UserAgent)
+	for _, s := range sessions {
+		if s.Device == device {
+			return
+		}
+	}
+	values := data{
+		"Email":  u.Email,
+		"Device": device,
+		"IP":     client.IP,
+		"Time":   time.Now().UTC().Format("2006-01-02 15:04 MST"),
+	}
+	go func() {
+		if err := m.Send(u.Email, "sign_in", values); err != nil {
+			log.Println("Sign in alert to", u.Email, "failed:", err)
+		}
+	}()
+}
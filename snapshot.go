@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/tectiv3/standardfile/db"
+)
+
+//snapshotter - store able to write consistent copy of its database to a file
+type snapshotter interface {
+	Snapshot(path string) error
+}
+
+//adminToken - bearer token of admin endpoints, they are off without it
+var adminToken string
+
+//UseAdminToken - sets token required by admin endpoints
+func UseAdminToken(token string) {
+	adminToken = token
+}
+
+//writeSnapshot - writes consistent copy of the database to new file at path and checks its integrity
+func writeSnapshot(store Store, path string) error {
+	s, ok := store.(snapshotter)
+	if !ok {
+		return db.ErrNoSnapshot
+	}
+	// database is copied into empty file readable by owner only
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists", path)
+	} else if err != nil {
+		return err
+	}
+	f.Close()
+	if err := s.Snapshot(path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err := db.CheckIntegrity(path); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("Snapshot failed integrity check: %v", err)
+	}
+	return nil
+}
+
+//withSnapshot - runs fn with snapshot in temporary file, which is removed afterwards
+func withSnapshot(store Store, fn func(f *os.File) error) error {
+	dir, err := ioutil.TempDir("", "standardfile")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.db")
+	if err := writeSnapshot(store, path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f)
+}
+
+//SnapshotDB - writes snapshot of the database to path from command line, it's safe to run next to the server
+func SnapshotDB(path string) {
+	db.Init(cfg.DBDriver, dbDSN())
+	store := NewSQLStore(db.Default())
+	if err := writeSnapshot(store, path); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Database snapshot written to", path)
+}
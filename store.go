@@ -0,0 +1,117 @@
+package main
+
+import "errors"
+
+var errNotFound = errors.New("Not found")
+
+var errEmailTaken = errors.New("This email is already registered")
+
+//UserStore - users persistence
+type UserStore interface {
+	CreateUser(u *User) error
+	UpdateUser(u *User) error
+	UserByUUID(uuid string) (User, error)
+	UserByEmail(email string) (User, error)
+	// Users returns all users ordered by registration
+	Users() (Users, error)
+	// SetUserDisabled disables or enables sign in of the user
+	SetUserDisabled(uuid string, disabled bool) error
+	// UserStats returns item counts and storage used by the user
+	UserStats(uuid string) (UserStats, error)
+	// ChangeEmail updates the user with new email, which must not be used by another account
+	ChangeEmail(u *User) error
+	// DeleteUser deletes the user with all their items, revisions, sessions, second factor, API tokens and settings in a single transaction
+	DeleteUser(uuid string) error
+}
+
+//ItemWriter - reads and writes single items
+type ItemWriter interface {
+	CreateItem(i *Item) error
+	UpdateItem(i *Item) error
+	DeleteItem(i *Item) error
+	ItemByUUID(userUUID, uuid string) (Item, error)
+	// ItemOwner returns uuid of the user owning the item, uuids are unique across all users
+	ItemOwner(uuid string) (string, error)
+	CreateRevision(r *Revision) error
+	// PruneRevisions deletes all but keep latest revisions of the item
+	PruneRevisions(userUUID, itemUUID string, keep int) error
+}
+
+//ItemStore - items persistence
+type ItemStore interface {
+	// ItemWriter methods of the store are applied one by one
+	ItemWriter
+	// WriteItems runs fn in a single transaction, which is rolled back if fn returns error
+	WriteItems(fn func(w ItemWriter) error) error
+	UserItems(userUUID string) (Items, error)
+	// EachItem runs fn for every item of the user matching filter, ordered by creation time.
+	// No read is held open while fn runs, so slow fn doesn't block writers
+	EachItem(userUUID string, filter itemFilter, fn func(Item) error) error
+	// ItemsChangedSince returns up to limit items changed after since, ordered by change sequence
+	ItemsChangedSince(userUUID string, since cursor, limit int) (Items, error)
+	// ChangeSeq returns sequence number of the user's latest committed change
+	ChangeSeq(userUUID string) (int64, error)
+	// ItemRevisions returns revisions of the item, newest first
+	ItemRevisions(userUUID, itemUUID string) (Revisions, error)
+	RevisionByUUID(userUUID, itemUUID, uuid string) (Revision, error)
+}
+
+//SessionStore - sessions persistence
+type SessionStore interface {
+	CreateSession(s *Session) error
+	UpdateSession(s *Session) error
+	SessionByUUID(userUUID, uuid string) (Session, error)
+	// UserSessions returns sessions of the user, most recently used first
+	UserSessions(userUUID string) (Sessions, error)
+	DeleteSession(userUUID, uuid string) error
+	// DeleteUserSessions deletes all sessions of the user except the given one
+	DeleteUserSessions(userUUID, except string) error
+}
+
+//MFAStore - second factor persistence, users have at most one
+type MFAStore interface {
+	CreateMFA(m *MFA) error
+	UpdateMFA(m *MFA) error
+	MFAByUser(userUUID string) (MFA, error)
+	DeleteMFA(userUUID string) error
+}
+
+//InviteStore - invite codes persistence
+type InviteStore interface {
+	CreateInvite(i *Invite) error
+	// Invites returns all invites, newest first
+	Invites() (Invites, error)
+	InviteByCode(code string) (Invite, error)
+	// RedeemInvite counts use of the invite, fails with errInvalidInvite if it's used up or expired
+	RedeemInvite(code string) error
+	DeleteInvite(code string) error
+}
+
+//APITokenStore - API tokens persistence
+type APITokenStore interface {
+	CreateAPIToken(t *APIToken) error
+	UpdateAPIToken(t *APIToken) error
+	// UserAPITokens returns tokens of the user, newest first
+	UserAPITokens(userUUID string) (APITokens, error)
+	APITokenByHash(hash string) (APIToken, error)
+	DeleteAPIToken(userUUID, uuid string) error
+	DeleteUserAPITokens(userUUID string) error
+}
+
+//SettingsStore - notification settings persistence, users without saved settings have defaults
+type SettingsStore interface {
+	UserSettings(userUUID string) (Settings, error)
+	// SaveSettings creates or replaces settings of the user
+	SaveSettings(s *Settings) error
+}
+
+//Store - storage backend for users, items, sessions, second factors, invites, API tokens and settings
+type Store interface {
+	UserStore
+	ItemStore
+	SessionStore
+	MFAStore
+	InviteStore
+	APITokenStore
+	SettingsStore
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	sync.RWMutex
+	users    map[string]User
+	sessions map[string]Session
+	mfa      map[string]MFA
+	invites  map[string]Invite
+	tokens   map[string]APIToken
+	settings map[string]Settings
+	data     memoryItems
+}
+
+//memoryItems - items and change counters of all users, not synchronized
+type memoryItems struct {
+	items     map[string]Item
+	seqs      map[string]int64
+	revisions map[string]Revision
+}
+
+//NewMemoryStore - in-memory store, data is lost on exit. Useful for tests
+func NewMemoryStore() Store {
+	return &memoryStore{
+		users:    map[string]User{},
+		sessions: map[string]Session{},
+		mfa:      map[string]MFA{},
+		invites:  map[string]Invite{},
+		tokens:   map[string]APIToken{},
+		settings: map[string]Settings{},
+		data: memoryItems{
+			items:     map[string]Item{},
+			seqs:      map[string]int64{},
+			revisions: map[string]Revision{},
+		},
+	}
+}
+
+func (s *memoryStore) CreateUser(u *User) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.users[u.UUID]; ok {
+		return fmt.Errorf("User %s already exists", u.UUID)
+	}
+	s.users[u.UUID] = *u
+	return nil
+}
+
+func (s *memoryStore) UpdateUser(u *User) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.users[u.UUID]; !ok {
+		return errNotFound
+	}
+	s.users[u.UUID] = *u
+	return nil
+}
+
+func (s *memoryStore) UserByUUID(uuid string) (User, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if u, ok := s.users[uuid]; ok {
+		return u, nil
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) UserByEmail(email string) (User, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) Users() (Users, error) {
+	s.RLock()
+	defer s.RUnlock()
+	users := Users{}
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(a, b int) bool {
+		return users[a].CreatedAt.Before(users[b].CreatedAt)
+	})
+	return users, nil
+}
+
+func (s *memoryStore) SetUserDisabled(uuid string, disabled bool) error {
+	s.Lock()
+	defer s.Unlock()
+	u, ok := s.users[uuid]
+	if !ok {
+		return errNotFound
+	}
+	u.Disabled = disabled
+	u.UpdatedAt = time.Now()
+	s.users[uuid] = u
+	return nil
+}
+
+func (s *memoryStore) UserStats(uuid string) (UserStats, error) {
+	s.RLock()
+	defer s.RUnlock()
+	stats := UserStats{ContentTypes: map[string]int{}}
+	for _, i := range s.data.items {
+		if i.UserUUID == uuid {
+			stats.add(i.ContentType, i.Deleted, 1, int64(len(i.Content)+len(i.EncItemKey)))
+		}
+	}
+	for _, r := range s.data.revisions {
+		if r.UserUUID == uuid {
+			stats.Revisions++
+			stats.RevisionsSize += int64(len(r.Content) + len(r.EncItemKey))
+		}
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) ChangeEmail(u *User) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.users[u.UUID]; !ok {
+		return errNotFound
+	}
+	for _, other := range s.users {
+		if other.Email == u.Email && other.UUID != u.UUID {
+			return errEmailTaken
+		}
+	}
+	s.users[u.UUID] = *u
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+	staged := s.data.clone()
+	for k, i := range staged.items {
+		if i.UserUUID == uuid {
+			delete(staged.items, k)
+		}
+	}
+	for k, r := range staged.revisions {
+		if r.UserUUID == uuid {
+			delete(staged.revisions, k)
+		}
+	}
+	delete(staged.seqs, uuid)
+	for k, session := range s.sessions {
+		if session.UserUUID == uuid {
+			delete(s.sessions, k)
+		}
+	}
+	delete(s.mfa, uuid)
+	delete(s.settings, uuid)
+	for k, t := range s.tokens {
+		if t.UserUUID == uuid {
+			delete(s.tokens, k)
+		}
+	}
+	delete(s.users, uuid)
+	s.data = staged
+	return nil
+}
+
+func (s *memoryStore) CreateItem(i *Item) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.CreateItem(i)
+	})
+}
+
+func (s *memoryStore) UpdateItem(i *Item) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.UpdateItem(i)
+	})
+}
+
+func (s *memoryStore) DeleteItem(i *Item) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.DeleteItem(i)
+	})
+}
+
+func (s *memoryStore) CreateRevision(r *Revision) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.CreateRevision(r)
+	})
+}
+
+func (s *memoryStore) PruneRevisions(userUUID, itemUUID string, keep int) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.PruneRevisions(userUUID, itemUUID, keep)
+	})
+}
+
+//WriteItems applies changes to a copy of items, which replaces current items when fn succeeds
+func (s *memoryStore) WriteItems(fn func(w ItemWriter) error) error {
+	s.Lock()
+	defer s.Unlock()
+	staged := s.data.clone()
+	if err := fn(staged); err != nil {
+		return err
+	}
+	s.data = staged
+	return nil
+}
+
+func (s *memoryStore) ItemByUUID(userUUID, uuid string) (Item, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.data.ItemByUUID(userUUID, uuid)
+}
+
+func (s *memoryStore) ItemOwner(uuid string) (string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.data.ItemOwner(uuid)
+}
+
+func (s *memoryStore) UserItems(userUUID string) (Items, error) {
+	return s.filterItems(func(i Item) bool {
+		return i.UserUUID == userUUID
+	}), nil
+}
+
+func (s *memoryStore) EachItem(userUUID string, filter itemFilter, fn func(Item) error) error {
+	items := s.filterItems(func(i Item) bool {
+		return i.UserUUID == userUUID && filter.matches(i)
+	})
+	sort.Slice(items, func(a, b int) bool {
+		if items[a].CreatedAt.Equal(items[b].CreatedAt) {
+			return items[a].UUID < items[b].UUID
+		}
+		return items[a].CreatedAt.Before(items[b].CreatedAt)
+	})
+	for _, i := range items {
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ItemsChangedSince(userUUID string, since cursor, limit int) (Items, error) {
+	items := s.filterItems(func(i Item) bool {
+		if i.UserUUID != userUUID {
+			return false
+		}
+		if since.UpdatedAt.IsZero() {
+			return i.ChangeSeq > since.Seq
+		}
+		return i.UpdatedAt.After(since.UpdatedAt) ||
+			(since.UUID != "" && i.UpdatedAt.Equal(since.UpdatedAt) && i.UUID > since.UUID)
+	})
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].ChangeSeq < items[b].ChangeSeq
+	})
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func (s *memoryStore) ChangeSeq(userUUID string) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.data.seqs[userUUID], nil
+}
+
+func (s *memoryStore) ItemRevisions(userUUID, itemUUID string) (Revisions, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.data.itemRevisions(userUUID, itemUUID), nil
+}
+
+func (s *memoryStore) RevisionByUUID(userUUID, itemUUID, uuid string) (Revision, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if r, ok := s.data.revisions[uuid]; ok && r.UserUUID == userUUID && r.ItemUUID == itemUUID {
+		return r, nil
+	}
+	return Revision{}, errNotFound
+}
+
+func (s *memoryStore) CreateSession(session *Session) error {
+	s.Lock()
+	defer s.Unlock()
+	s.sessions[session.UUID] = *session
+	return nil
+}
+
+func (s *memoryStore) UpdateSession(session *Session) error {
+	s.Lock()
+	defer s.Unlock()
+	if current, ok := s.sessions[session.UUID]; ok && current.UserUUID == session.UserUUID {
+		s.sessions[session.UUID] = *session
+	}
+	return nil
+}
+
+func (s *memoryStore) SessionByUUID(userUUID, uuid string) (Session, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if session, ok := s.sessions[uuid]; ok && session.UserUUID == userUUID {
+		return session, nil
+	}
+	return Session{}, errNotFound
+}
+
+func (s *memoryStore) UserSessions(userUUID string) (Sessions, error) {
+	s.RLock()
+	defer s.RUnlock()
+	sessions := Sessions{}
+	for _, session := range s.sessions {
+		if session.UserUUID == userUUID {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(a, b int) bool {
+		return sessions[a].UpdatedAt.After(sessions[b].UpdatedAt)
+	})
+	return sessions, nil
+}
+
+func (s *memoryStore) DeleteSession(userUUID, uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+	if session, ok := s.sessions[uuid]; ok && session.UserUUID == userUUID {
+		delete(s.sessions, uuid)
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteUserSessions(userUUID, except string) error {
+	s.Lock()
+	defer s.Unlock()
+	for uuid, session := range s.sessions {
+		if session.UserUUID == userUUID && uuid != except {
+			delete(s.sessions, uuid)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateMFA(m *MFA) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.mfa[m.UserUUID]; ok {
+		return fmt.Errorf("MFA of user %s already exists", m.UserUUID)
+	}
+	s.mfa[m.UserUUID] = *m
+	return nil
+}
+
+func (s *memoryStore) UpdateMFA(m *MFA) error {
+	s.Lock()
+	defer s.Unlock()
+	if current, ok := s.mfa[m.UserUUID]; ok && current.UUID == m.UUID {
+		s.mfa[m.UserUUID] = *m
+	}
+	return nil
+}
+
+func (s *memoryStore) MFAByUser(userUUID string) (MFA, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if m, ok := s.mfa[userUUID]; ok {
+		return m, nil
+	}
+	return MFA{}, errNotFound
+}
+
+func (s *memoryStore) DeleteMFA(userUUID string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.mfa, userUUID)
+	return nil
+}
+
+func (s *memoryStore) CreateInvite(i *Invite) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.invites[i.Code]; ok {
+		return fmt.Errorf("Invite %s already exists", i.Code)
+	}
+	s.invites[i.Code] = *i
+	return nil
+}
+
+func (s *memoryStore) Invites() (Invites, error) {
+	s.RLock()
+	defer s.RUnlock()
+	invites := Invites{}
+	for _, i := range s.invites {
+		invites = append(invites, i)
+	}
+	sort.Slice(invites, func(a, b int) bool {
+		return invites[a].CreatedAt.After(invites[b].CreatedAt)
+	})
+	return invites, nil
+}
+
+func (s *memoryStore) InviteByCode(code string) (Invite, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if i, ok := s.invites[code]; ok {
+		return i, nil
+	}
+	return Invite{}, errNotFound
+}
+
+func (s *memoryStore) RedeemInvite(code string) error {
+	s.Lock()
+	defer s.Unlock()
+	i, ok := s.invites[code]
+	if !ok || !i.valid(time.Now()) {
+		return errInvalidInvite
+	}
+	i.Uses++
+	i.UpdatedAt = time.Now()
+	s.invites[code] = i
+	return nil
+}
+
+func (s *memoryStore) DeleteInvite(code string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.invites, code)
+	return nil
+}
+
+func (s *memoryStore) CreateAPIToken(t *APIToken) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.tokens[t.UUID]; ok {
+		return fmt.Errorf("API token %s already exists", t.UUID)
+	}
+	s.tokens[t.UUID] = *t
+	return nil
+}
+
+func (s *memoryStore) UpdateAPIToken(t *APIToken) error {
+	s.Lock()
+	defer s.Unlock()
+	if current, ok := s.tokens[t.UUID]; ok && current.UserUUID == t.UserUUID {
+		current.LastUsedAt = t.LastUsedAt
+		s.tokens[t.UUID] = current
+	}
+	return nil
+}
+
+func (s *memoryStore) UserAPITokens(userUUID string) (APITokens, error) {
+	s.RLock()
+	defer s.RUnlock()
+	tokens := APITokens{}
+	for _, t := range s.tokens {
+		if t.UserUUID == userUUID {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(a, b int) bool {
+		return tokens[a].CreatedAt.After(tokens[b].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (s *memoryStore) APITokenByHash(hash string) (APIToken, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, t := range s.tokens {
+		if t.TokenHash == hash {
+			return t, nil
+		}
+	}
+	return APIToken{}, errNotFound
+}
+
+func (s *memoryStore) DeleteAPIToken(userUUID, uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+	if t, ok := s.tokens[uuid]; ok && t.UserUUID == userUUID {
+		delete(s.tokens, uuid)
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteUserAPITokens(userUUID string) error {
+	s.Lock()
+	defer s.Unlock()
+	for uuid, t := range s.tokens {
+		if t.UserUUID == userUUID {
+			delete(s.tokens, uuid)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) UserSettings(userUUID string) (Settings, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if settings, ok := s.settings[userUUID]; ok {
+		return settings, nil
+	}
+	return Settings{}, errNotFound
+}
+
+func (s *memoryStore) SaveSettings(settings *Settings) error {
+	s.Lock()
+	defer s.Unlock()
+	s.settings[settings.UserUUID] = *settings
+	return nil
+}
+
+//filterItems returns matching items ordered by updated_at desc
+func (s *memoryStore) filterItems(match func(Item) bool) Items {
+	s.RLock()
+	defer s.RUnlock()
+	items := Items{}
+	for _, i := range s.data.items {
+		if match(i) {
+			items = append(items, i)
+		}
+	}
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].UpdatedAt.After(items[b].UpdatedAt)
+	})
+	return items
+}
+
+func (m memoryItems) clone() memoryItems {
+	c := memoryItems{
+		items:     make(map[string]Item, len(m.items)),
+		seqs:      make(map[string]int64, len(m.seqs)),
+		revisions: make(map[string]Revision, len(m.revisions)),
+	}
+	for k, v := range m.items {
+		c.items[k] = v
+	}
+	for k, v := range m.seqs {
+		c.seqs[k] = v
+	}
+	for k, v := range m.revisions {
+		c.revisions[k] = v
+	}
+	return c
+}
+
+func (m memoryItems) CreateItem(i *Item) error {
+	if _, ok := m.items[i.UUID]; ok {
+		return fmt.Errorf("Item %s already exists", i.UUID)
+	}
+	i.ChangeSeq = m.nextChangeSeq(i.UserUUID)
+	m.items[i.UUID] = *i
+	return nil
+}
+
+func (m memoryItems) UpdateItem(i *Item) error {
+	item, ok := m.items[i.UUID]
+	if !ok || item.UserUUID != i.UserUUID {
+		return nil // same as UPDATE matching no rows
+	}
+	item.Content = i.Content
+	item.EncItemKey = i.EncItemKey
+	item.AuthHash = i.AuthHash
+	item.Deleted = i.Deleted
+	item.UpdatedAt = i.UpdatedAt
+	item.ChangeSeq = m.nextChangeSeq(i.UserUUID)
+	i.ChangeSeq = item.ChangeSeq
+	m.items[i.UUID] = item
+	return nil
+}
+
+func (m memoryItems) DeleteItem(i *Item) error {
+	item, ok := m.items[i.UUID]
+	if !ok || item.UserUUID != i.UserUUID {
+		return nil
+	}
+	item.Content = ""
+	item.EncItemKey = ""
+	item.AuthHash = ""
+	item.Deleted = true
+	item.UpdatedAt = i.UpdatedAt
+	item.ChangeSeq = m.nextChangeSeq(i.UserUUID)
+	i.ChangeSeq = item.ChangeSeq
+	m.items[i.UUID] = item
+	return nil
+}
+
+func (m memoryItems) ItemByUUID(userUUID, uuid string) (Item, error) {
+	if i, ok := m.items[uuid]; ok && i.UserUUID == userUUID {
+		return i, nil
+	}
+	return Item{}, errNotFound
+}
+
+func (m memoryItems) ItemOwner(uuid string) (string, error) {
+	if i, ok := m.items[uuid]; ok {
+		return i.UserUUID, nil
+	}
+	return "", errNotFound
+}
+
+func (m memoryItems) nextChangeSeq(userUUID string) int64 {
+	m.seqs[userUUID]++
+	return m.seqs[userUUID]
+}
+
+func (m memoryItems) CreateRevision(r *Revision) error {
+	m.revisions[r.UUID] = *r
+	return nil
+}
+
+func (m memoryItems) PruneRevisions(userUUID, itemUUID string, keep int) error {
+	revisions := m.itemRevisions(userUUID, itemUUID)
+	for len(revisions) > keep {
+		delete(m.revisions, revisions[len(revisions)-1].UUID)
+		revisions = revisions[:len(revisions)-1]
+	}
+	return nil
+}
+
+//itemRevisions returns revisions of the item ordered by created_at desc
+func (m memoryItems) itemRevisions(userUUID, itemUUID string) Revisions {
+	revisions := Revisions{}
+	for _, r := range m.revisions {
+		if r.UserUUID == userUUID && r.ItemUUID == itemUUID {
+			revisions = append(revisions, r)
+		}
+	}
+	sort.Slice(revisions, func(a, b int) bool {
+		return revisions[a].CreatedAt.After(revisions[b].CreatedAt)
+	})
+	return revisions
+}
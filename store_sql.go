@@ -0,0 +1,480 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kisielk/sqlstruct"
+	"github.com/tectiv3/standardfile/db"
+)
+
+type sqlStore struct {
+	db *db.Database
+}
+
+//NewSQLStore - store backed by sqlite or postgres database
+func NewSQLStore(database *db.Database) Store {
+	return sqlStore{database}
+}
+
+//Snapshot - writes consistent copy of the database to path, sqlite only
+func (s sqlStore) Snapshot(path string) error {
+	return s.db.Snapshot(path)
+}
+
+func (s sqlStore) CreateUser(u *User) error {
+	return s.db.Query("INSERT INTO users (uuid, email, password, pw_func, pw_alg, pw_cost, pw_key_size, pw_nonce, pw_auth, pw_salt, version, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)", u.UUID, u.Email, u.Password, u.PwFunc, u.PwAlg, u.PwCost, u.PwKeySize, u.PwNonce, u.PwAuth, u.PwSalt, u.Version, u.CreatedAt, u.UpdatedAt)
+}
+
+func (s sqlStore) UpdateUser(u *User) error {
+	return s.db.Query("UPDATE `users` SET `password`=?, `pw_func`=?, `pw_alg`=?, `pw_cost`=?, `pw_key_size`=?, `pw_nonce`=?, `pw_salt`=?, `version`=?, `updated_at`=? WHERE `uuid`=?", u.Password, u.PwFunc, u.PwAlg, u.PwCost, u.PwKeySize, u.PwNonce, u.PwSalt, u.Version, u.UpdatedAt, u.UUID)
+}
+
+func (s sqlStore) UserByUUID(uuid string) (User, error) {
+	return s.selectUser(fmt.Sprintf("SELECT %s FROM `users` WHERE `uuid`=?", sqlstruct.Columns(User{})), uuid)
+}
+
+func (s sqlStore) UserByEmail(email string) (User, error) {
+	return s.selectUser(fmt.Sprintf("SELECT %s FROM `users` WHERE `email`=?", sqlstruct.Columns(User{})), email)
+}
+
+func (s sqlStore) Users() (Users, error) {
+	users := Users{}
+	err := s.db.Select(fmt.Sprintf("SELECT %s FROM `users` ORDER BY `created_at`, `email`", sqlstruct.Columns(User{})), &users)
+	return users, err
+}
+
+func (s sqlStore) SetUserDisabled(uuid string, disabled bool) error {
+	return s.db.Query("UPDATE `users` SET `disabled`=?, `updated_at`=? WHERE `uuid`=?", disabled, time.Now(), uuid)
+}
+
+func (s sqlStore) UserStats(uuid string) (UserStats, error) {
+	stats := UserStats{ContentTypes: map[string]int{}}
+	err := s.db.Each("SELECT `content_type`, `deleted`, COUNT(*), COALESCE(SUM(LENGTH(`content`) + LENGTH(`enc_item_key`)), 0) FROM `items` WHERE `user_uuid`=? GROUP BY `content_type`, `deleted`", func(rows *sql.Rows) error {
+		var contentType string
+		var deleted bool
+		var count int
+		var size int64
+		if err := rows.Scan(&contentType, &deleted, &count, &size); err != nil {
+			return err
+		}
+		stats.add(contentType, deleted, count, size)
+		return nil
+	}, uuid)
+	if err != nil {
+		return stats, err
+	}
+	err = s.db.Each("SELECT COUNT(*), COALESCE(SUM(LENGTH(`content`) + LENGTH(`enc_item_key`)), 0) FROM `revisions` WHERE `user_uuid`=?", func(rows *sql.Rows) error {
+		return rows.Scan(&stats.Revisions, &stats.RevisionsSize)
+	}, uuid)
+	return stats, err
+}
+
+func (s sqlStore) ChangeEmail(u *User) error {
+	return s.db.Transaction(func(tx *db.Tx) error {
+		taken, err := tx.SelectFirst("SELECT COUNT(*) FROM `users` WHERE `email`=? AND `uuid`<>?", u.Email, u.UUID)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(taken) != "0" {
+			return errEmailTaken
+		}
+		_, err = tx.Exec("UPDATE `users` SET `email`=?, `password`=?, `pw_func`=?, `pw_alg`=?, `pw_cost`=?, `pw_key_size`=?, `pw_nonce`=?, `pw_salt`=?, `version`=?, `updated_at`=? WHERE `uuid`=?", u.Email, u.Password, u.PwFunc, u.PwAlg, u.PwCost, u.PwKeySize, u.PwNonce, u.PwSalt, u.Version, u.UpdatedAt, u.UUID)
+		return err
+	})
+}
+
+func (s sqlStore) DeleteUser(uuid string) error {
+	return s.db.Transaction(func(tx *db.Tx) error {
+		for _, table := range []string{"revisions", "items", "sessions", "mfa", "api_tokens", "settings"} {
+			if _, err := tx.Exec("DELETE FROM `"+table+"` WHERE `user_uuid`=?", uuid); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("DELETE FROM `users` WHERE `uuid`=?", uuid)
+		return err
+	})
+}
+
+func (s sqlStore) selectUser(query string, args ...interface{}) (User, error) {
+	u := User{}
+	if _, err := s.db.SelectStruct(query, &u, args...); err != nil {
+		return u, err
+	}
+	if u.UUID == "" {
+		return u, errNotFound
+	}
+	return u, nil
+}
+
+func (s sqlStore) CreateItem(i *Item) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.CreateItem(i)
+	})
+}
+
+func (s sqlStore) UpdateItem(i *Item) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.UpdateItem(i)
+	})
+}
+
+func (s sqlStore) DeleteItem(i *Item) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.DeleteItem(i)
+	})
+}
+
+func (s sqlStore) CreateRevision(r *Revision) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.CreateRevision(r)
+	})
+}
+
+func (s sqlStore) PruneRevisions(userUUID, itemUUID string, keep int) error {
+	return s.WriteItems(func(w ItemWriter) error {
+		return w.PruneRevisions(userUUID, itemUUID, keep)
+	})
+}
+
+func (s sqlStore) WriteItems(fn func(w ItemWriter) error) error {
+	return s.db.Transaction(func(tx *db.Tx) error {
+		return fn(sqlItemWriter{tx})
+	})
+}
+
+func (s sqlStore) ItemByUUID(userUUID, uuid string) (Item, error) {
+	i := Item{}
+	if _, err := s.db.SelectStruct("SELECT * FROM `items` WHERE `user_uuid`=? AND `uuid`=?", &i, userUUID, uuid); err != nil {
+		return i, err
+	}
+	if i.UUID == "" {
+		return i, errNotFound
+	}
+	return i, nil
+}
+
+func (s sqlStore) ItemOwner(uuid string) (string, error) {
+	owner, err := s.db.SelectFirst("SELECT `user_uuid` FROM `items` WHERE `uuid`=?", uuid)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return owner.(string), nil
+}
+
+//sqlItemWriter - writes items within transaction
+type sqlItemWriter struct {
+	tx *db.Tx
+}
+
+func (w sqlItemWriter) CreateItem(i *Item) (err error) {
+	if i.ChangeSeq, err = w.nextChangeSeq(i.UserUUID); err != nil {
+		return err
+	}
+	_, err = w.tx.Exec("INSERT INTO `items` (`uuid`, `user_uuid`, content,  content_type, enc_item_key, auth_hash, deleted, change_seq, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?,?,?)", i.UUID, i.UserUUID, i.Content, i.ContentType, i.EncItemKey, i.AuthHash, i.Deleted, i.ChangeSeq, i.CreatedAt, i.UpdatedAt)
+	return err
+}
+
+func (w sqlItemWriter) UpdateItem(i *Item) (err error) {
+	if i.ChangeSeq, err = w.nextChangeSeq(i.UserUUID); err != nil {
+		return err
+	}
+	_, err = w.tx.Exec("UPDATE `items` SET `content`=?, `enc_item_key`=?, `auth_hash`=?, `deleted`=?, `change_seq`=?, `updated_at`=? WHERE `uuid`=? AND `user_uuid`=?", i.Content, i.EncItemKey, i.AuthHash, i.Deleted, i.ChangeSeq, i.UpdatedAt, i.UUID, i.UserUUID)
+	return err
+}
+
+func (w sqlItemWriter) DeleteItem(i *Item) (err error) {
+	if i.ChangeSeq, err = w.nextChangeSeq(i.UserUUID); err != nil {
+		return err
+	}
+	_, err = w.tx.Exec("UPDATE `items` SET `content`='', `enc_item_key`='', `auth_hash`='',`deleted`=?, `change_seq`=?, `updated_at`=? WHERE `uuid`=? AND `user_uuid`=?", true, i.ChangeSeq, i.UpdatedAt, i.UUID, i.UserUUID)
+	return err
+}
+
+//ItemByUUID - on postgres the row stays locked till the end of transaction, so the item checked for conflicts
+//can't be changed by a concurrent sync before it's saved. SQLite transactions fail to commit instead
+func (w sqlItemWriter) ItemByUUID(userUUID, uuid string) (Item, error) {
+	items := Items{}
+	query := "SELECT * FROM `items` WHERE `user_uuid`=? AND `uuid`=?"
+	if db.Driver() == db.Postgres {
+		query += " FOR UPDATE"
+	}
+	if err := w.tx.Select(query, &items, userUUID, uuid); err != nil {
+		return Item{}, err
+	}
+	if len(items) == 0 {
+		return Item{}, errNotFound
+	}
+	return items[0], nil
+}
+
+func (w sqlItemWriter) ItemOwner(uuid string) (string, error) {
+	owner, err := w.tx.SelectFirst("SELECT `user_uuid` FROM `items` WHERE `uuid`=?", uuid)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return owner.(string), nil
+}
+
+func (w sqlItemWriter) CreateRevision(r *Revision) error {
+	_, err := w.tx.Exec("INSERT INTO `revisions` (`uuid`, `item_uuid`, `user_uuid`, content, content_type, enc_item_key, auth_hash, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?,?)", r.UUID, r.ItemUUID, r.UserUUID, r.Content, r.ContentType, r.EncItemKey, r.AuthHash, r.CreatedAt, r.UpdatedAt)
+	return err
+}
+
+func (w sqlItemWriter) PruneRevisions(userUUID, itemUUID string, keep int) error {
+	_, err := w.tx.Exec("DELETE FROM `revisions` WHERE `user_uuid`=? AND `item_uuid`=? AND `uuid` NOT IN (SELECT `uuid` FROM `revisions` WHERE `user_uuid`=? AND `item_uuid`=? ORDER BY `created_at` DESC LIMIT ?)", userUUID, itemUUID, userUUID, itemUUID, keep)
+	return err
+}
+
+//nextChangeSeq increments user's change counter. The user row stays locked until the transaction ends,
+//so changes become visible in the order of their sequence numbers
+func (w sqlItemWriter) nextChangeSeq(userUUID string) (int64, error) {
+	if _, err := w.tx.Exec("UPDATE `users` SET `change_seq`=`change_seq`+1 WHERE `uuid`=?", userUUID); err != nil {
+		return 0, err
+	}
+	seq, err := w.tx.SelectFirst("SELECT `change_seq` FROM `users` WHERE `uuid`=?", userUUID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(seq.(string), 10, 64)
+}
+
+func (s sqlStore) ChangeSeq(userUUID string) (int64, error) {
+	seq, err := s.db.SelectFirst("SELECT `change_seq` FROM `users` WHERE `uuid`=?", userUUID)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(seq.(string), 10, 64)
+}
+
+func (s sqlStore) UserItems(userUUID string) (Items, error) {
+	items := Items{}
+	err := s.db.Select("SELECT * FROM `items` WHERE `user_uuid`=? ORDER BY `updated_at` DESC", &items, userUUID)
+	return items, err
+}
+
+//eachItemPage - items EachItem reads with one query, pages are read by (created_at, uuid) of the last item
+const eachItemPage = 100
+
+func (s sqlStore) EachItem(userUUID string, filter itemFilter, fn func(Item) error) error {
+	query := "SELECT * FROM `items` WHERE `user_uuid`=? AND `deleted`=?"
+	args := []interface{}{userUUID, filter.Deleted}
+	if len(filter.ContentTypes) > 0 {
+		query += " AND `content_type` IN (?" + strings.Repeat(",?", len(filter.ContentTypes)-1) + ")"
+		for _, t := range filter.ContentTypes {
+			args = append(args, t)
+		}
+	}
+	page := query
+	pageArgs := args
+	for {
+		items := Items{}
+		if err := s.db.Select(page+" ORDER BY `created_at`, `uuid` LIMIT ?", &items, append(pageArgs, eachItemPage)...); err != nil {
+			return err
+		}
+		for _, i := range items {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		if len(items) < eachItemPage {
+			return nil
+		}
+		last := items[len(items)-1]
+		page = query + " AND (`created_at` > ? OR (`created_at` = ? AND `uuid` > ?))"
+		pageArgs = append(args[:len(args):len(args)], last.CreatedAt, last.CreatedAt, last.UUID)
+	}
+}
+
+func (s sqlStore) ItemsChangedSince(userUUID string, since cursor, limit int) (Items, error) {
+	items := Items{}
+	var err error
+	switch {
+	case since.UpdatedAt.IsZero():
+		err = s.db.Select("SELECT * FROM `items` WHERE `user_uuid`=? AND `change_seq` > ? ORDER BY `change_seq` LIMIT ?", &items, userUUID, since.Seq, limit)
+	case since.UUID == "":
+		err = s.db.Select("SELECT * FROM `items` WHERE `user_uuid`=? AND `updated_at` > ? ORDER BY `change_seq` LIMIT ?", &items, userUUID, since.UpdatedAt, limit)
+	default:
+		err = s.db.Select("SELECT * FROM `items` WHERE `user_uuid`=? AND (`updated_at` > ? OR (`updated_at` = ? AND `uuid` > ?)) ORDER BY `change_seq` LIMIT ?", &items, userUUID, since.UpdatedAt, since.UpdatedAt, since.UUID, limit)
+	}
+	return items, err
+}
+
+func (s sqlStore) ItemRevisions(userUUID, itemUUID string) (Revisions, error) {
+	revisions := Revisions{}
+	err := s.db.Select("SELECT * FROM `revisions` WHERE `user_uuid`=? AND `item_uuid`=? ORDER BY `created_at` DESC", &revisions, userUUID, itemUUID)
+	return revisions, err
+}
+
+func (s sqlStore) RevisionByUUID(userUUID, itemUUID, uuid string) (Revision, error) {
+	r := Revision{}
+	if _, err := s.db.SelectStruct("SELECT * FROM `revisions` WHERE `user_uuid`=? AND `item_uuid`=? AND `uuid`=?", &r, userUUID, itemUUID, uuid); err != nil {
+		return r, err
+	}
+	if r.UUID == "" {
+		return r, errNotFound
+	}
+	return r, nil
+}
+
+func (s sqlStore) CreateSession(session *Session) error {
+	return s.db.Query("INSERT INTO `sessions` (`uuid`, `user_uuid`, `api`, `user_agent`, `device`, `ip`, `refresh_hash`, `refresh_expires_at`, `created_at`, `updated_at`) VALUES(?,?,?,?,?,?,?,?,?,?)", session.UUID, session.UserUUID, session.API, session.UserAgent, session.Device, session.IP, session.RefreshHash, session.RefreshExpiresAt, session.CreatedAt, session.UpdatedAt)
+}
+
+func (s sqlStore) UpdateSession(session *Session) error {
+	return s.db.Query("UPDATE `sessions` SET `ip`=?, `refresh_hash`=?, `refresh_expires_at`=?, `updated_at`=? WHERE `user_uuid`=? AND `uuid`=?", session.IP, session.RefreshHash, session.RefreshExpiresAt, session.UpdatedAt, session.UserUUID, session.UUID)
+}
+
+func (s sqlStore) SessionByUUID(userUUID, uuid string) (Session, error) {
+	session := Session{}
+	if _, err := s.db.SelectStruct("SELECT * FROM `sessions` WHERE `user_uuid`=? AND `uuid`=?", &session, userUUID, uuid); err != nil {
+		return session, err
+	}
+	if session.UUID == "" {
+		return session, errNotFound
+	}
+	return session, nil
+}
+
+func (s sqlStore) UserSessions(userUUID string) (Sessions, error) {
+	sessions := Sessions{}
+	err := s.db.Select("SELECT * FROM `sessions` WHERE `user_uuid`=? ORDER BY `updated_at` DESC", &sessions, userUUID)
+	return sessions, err
+}
+
+func (s sqlStore) DeleteSession(userUUID, uuid string) error {
+	return s.db.Query("DELETE FROM `sessions` WHERE `user_uuid`=? AND `uuid`=?", userUUID, uuid)
+}
+
+func (s sqlStore) DeleteUserSessions(userUUID, except string) error {
+	return s.db.Query("DELETE FROM `sessions` WHERE `user_uuid`=? AND `uuid`<>?", userUUID, except)
+}
+
+func (s sqlStore) CreateMFA(m *MFA) error {
+	return s.db.Query("INSERT INTO `mfa` (`uuid`, `user_uuid`, `secret`, `recovery_codes`, `enabled`, `last_step`, `created_at`, `updated_at`) VALUES(?,?,?,?,?,?,?,?)", m.UUID, m.UserUUID, m.Secret, m.RecoveryCodes, m.Enabled, m.LastStep, m.CreatedAt, m.UpdatedAt)
+}
+
+func (s sqlStore) UpdateMFA(m *MFA) error {
+	return s.db.Query("UPDATE `mfa` SET `recovery_codes`=?, `enabled`=?, `last_step`=?, `updated_at`=? WHERE `uuid`=? AND `user_uuid`=?", m.RecoveryCodes, m.Enabled, m.LastStep, m.UpdatedAt, m.UUID, m.UserUUID)
+}
+
+func (s sqlStore) MFAByUser(userUUID string) (MFA, error) {
+	m := MFA{}
+	if _, err := s.db.SelectStruct("SELECT * FROM `mfa` WHERE `user_uuid`=?", &m, userUUID); err != nil {
+		return m, err
+	}
+	if m.UUID == "" {
+		return m, errNotFound
+	}
+	return m, nil
+}
+
+func (s sqlStore) DeleteMFA(userUUID string) error {
+	return s.db.Query("DELETE FROM `mfa` WHERE `user_uuid`=?", userUUID)
+}
+
+func (s sqlStore) CreateInvite(i *Invite) error {
+	return s.db.Query("INSERT INTO `invites` (`code`, `max_uses`, `uses`, `expires_at`, `created_at`, `updated_at`) VALUES(?,?,?,?,?,?)", i.Code, i.MaxUses, i.Uses, i.ExpiresAt, i.CreatedAt, i.UpdatedAt)
+}
+
+func (s sqlStore) Invites() (Invites, error) {
+	invites := Invites{}
+	err := s.db.Select("SELECT * FROM `invites` ORDER BY `created_at` DESC", &invites)
+	return invites, err
+}
+
+func (s sqlStore) InviteByCode(code string) (Invite, error) {
+	i := Invite{}
+	if _, err := s.db.SelectStruct("SELECT * FROM `invites` WHERE `code`=?", &i, code); err != nil {
+		return i, err
+	}
+	if i.Code == "" {
+		return i, errNotFound
+	}
+	return i, nil
+}
+
+func (s sqlStore) RedeemInvite(code string) error {
+	return s.db.Transaction(func(tx *db.Tx) error {
+		invites := Invites{}
+		if err := tx.Select("SELECT * FROM `invites` WHERE `code`=?", &invites, code); err != nil {
+			return err
+		}
+		if len(invites) == 0 || !invites[0].valid(time.Now()) {
+			return errInvalidInvite
+		}
+		// concurrent registration may have used the invite since it was read
+		res, err := tx.Exec("UPDATE `invites` SET `uses`=`uses`+1, `updated_at`=? WHERE `code`=? AND `uses`=?", time.Now(), code, invites[0].Uses)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return errInvalidInvite
+		}
+		return nil
+	})
+}
+
+func (s sqlStore) DeleteInvite(code string) error {
+	return s.db.Query("DELETE FROM `invites` WHERE `code`=?", code)
+}
+
+func (s sqlStore) CreateAPIToken(t *APIToken) error {
+	return s.db.Query("INSERT INTO `api_tokens` (`uuid`, `user_uuid`, `name`, `token_hash`, `scopes`, `expires_at`, `last_used_at`, `created_at`, `updated_at`) VALUES(?,?,?,?,?,?,?,?,?)", t.UUID, t.UserUUID, t.Name, t.TokenHash, t.Scopes, t.ExpiresAt, t.LastUsedAt, t.CreatedAt, t.UpdatedAt)
+}
+
+func (s sqlStore) UpdateAPIToken(t *APIToken) error {
+	return s.db.Query("UPDATE `api_tokens` SET `last_used_at`=? WHERE `user_uuid`=? AND `uuid`=?", t.LastUsedAt, t.UserUUID, t.UUID)
+}
+
+func (s sqlStore) UserAPITokens(userUUID string) (APITokens, error) {
+	tokens := APITokens{}
+	err := s.db.Select("SELECT * FROM `api_tokens` WHERE `user_uuid`=? ORDER BY `created_at` DESC", &tokens, userUUID)
+	return tokens, err
+}
+
+func (s sqlStore) APITokenByHash(hash string) (APIToken, error) {
+	t := APIToken{}
+	if _, err := s.db.SelectStruct("SELECT * FROM `api_tokens` WHERE `token_hash`=?", &t, hash); err != nil {
+		return t, err
+	}
+	if t.UUID == "" {
+		return t, errNotFound
+	}
+	return t, nil
+}
+
+func (s sqlStore) DeleteAPIToken(userUUID, uuid string) error {
+	return s.db.Query("DELETE FROM `api_tokens` WHERE `user_uuid`=? AND `uuid`=?", userUUID, uuid)
+}
+
+func (s sqlStore) DeleteUserAPITokens(userUUID string) error {
+	return s.db.Query("DELETE FROM `api_tokens` WHERE `user_uuid`=?", userUUID)
+}
+
+func (s sqlStore) UserSettings(userUUID string) (Settings, error) {
+	settings := Settings{}
+	if _, err := s.db.SelectStruct("SELECT * FROM `settings` WHERE `user_uuid`=?", &settings, userUUID); err != nil {
+		return settings, err
+	}
+	if settings.UserUUID == "" {
+		return settings, errNotFound
+	}
+	return settings, nil
+}
+
+func (s sqlStore) SaveSettings(settings *Settings) error {
+	return s.db.Query("INSERT INTO `settings` (`user_uuid`, `email_backups`, `sign_in_alerts`, `updated_at`) VALUES(?,?,?,?) ON CONFLICT (`user_uuid`) DO UPDATE SET `email_backups`=excluded.`email_backups`, `sign_in_alerts`=excluded.`sign_in_alerts`, `updated_at`=excluded.`updated_at`", settings.UserUUID, settings.EmailBackups, settings.SignInAlerts, settings.UpdatedAt)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//BackupTarget - storage scheduled backups are written to. Names are slash separated paths
+type BackupTarget interface {
+	// Put stores content written by write under name, replacing existing one
+	Put(name string, write func(w io.Writer) error) error
+	// List returns names starting with prefix, sorted
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+}
+
+//dirTarget - backups stored as files in local directory
+type dirTarget struct {
+	dir string
+}
+
+//NewDirTarget - target writing backups to files under dir
+func NewDirTarget(dir string) BackupTarget {
+	return dirTarget{dir}
+}
+
+func (t dirTarget) path(name string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(name))
+}
+
+//Put - writes to temporary file first, so an interrupted backup doesn't replace the previous one
+func (t dirTarget) Put(name string, write func(w io.Writer) error) error {
+	path := t.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (t dirTarget) List(prefix string) ([]string, error) {
+	names := []string{}
+	err := filepath.Walk(t.dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(t.dir, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+//Delete - removes the file and its directory once it's empty
+func (t dirTarget) Delete(name string) error {
+	path := t.path(name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	os.Remove(filepath.Dir(path))
+	return nil
+}
@@ -1,18 +1,21 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
-	"os"
+	"log"
 	"strconv"
 	"strings"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/kisielk/sqlstruct"
 	"github.com/satori/go.uuid"
 	"github.com/tectiv3/standardfile/db"
+	"golang.org/x/crypto/bcrypt"
 )
 
 //User is the user type
@@ -27,10 +30,15 @@ type User struct {
 	PwNonce   string    `json:"pw_nonce,omitempty"    sql:"pw_nonce"`
 	PwAuth    string    `json:"pw_auth,omitempty"     sql:"pw_auth"`
 	PwSalt    string    `json:"pw_salt,omitempty"     sql:"pw_salt"`
+	Version   string    `json:"version,omitempty"     sql:"version"`
+	Disabled  bool      `json:"-"           sql:"disabled"`
 	CreatedAt time.Time `json:"created_at"  sql:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"  sql:"updated_at"`
 }
 
+//Users - list of users
+type Users []User
+
 //Params is params type
 type Params struct {
 	PwFunc    string `json:"pw_func"     sql:"pw_func"`
@@ -44,28 +52,19 @@ type Params struct {
 //NewPassword - incomming json password change
 type NewPassword struct {
 	User
+	API             string `json:"api"`
 	CurrentPassword string `json:"current_password"`
 	NewPassword     string `json:"new_password"`
+	NewEmail        string `json:"new_email"`
 }
 
 //UserClaims - jwt claims
 type UserClaims struct {
-	UUID   string `json:"uuid"`
-	PwHash string `json:"pw_hash"`
+	UUID      string `json:"uuid"`
+	SessionID string `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
 
-//SigningKey - export to routing
-var SigningKey = []byte{}
-
-func init() {
-	key := os.Getenv("SECRET_KEY_BASE")
-	if key == "" {
-		key = "qA6irmDikU6RkCM4V0cJiUJEROuCsqTa1esexI4aWedSv405v8lw4g1KB1nQVsSdCrcyRlKFdws4XPlsArWwv9y5Xr5Jtkb11w1NxKZabOUa7mxjeENuCs31Y1Ce49XH9kGMPe0ms7iV7e9F6WgnsPFGOlIA3CwfGyr12okas2EsDd71SbSnA0zJYjyxeCVCZJWISmLB"
-	}
-	SigningKey = []byte(key)
-}
-
 //NewUser - user constructor
 func NewUser() User {
 	user := User{}
@@ -101,11 +100,33 @@ func (u *User) LoadValue(name string, value []string) {
 		u.PwKeySize, _ = strconv.Atoi(value[0])
 	case "pw_nonce":
 		u.PwNonce = value[0]
+	case "version":
+		u.Version = value[0]
+	}
+}
+
+//validateParams - checks key params of the user's protocol version.
+//Since 004 keys are derived with Argon2 from identifier and pw_nonce, pbkdf2 params are dropped
+func (u *User) validateParams() error {
+	switch u.Version {
+	case "", "001", "002", "003":
+		return nil
+	case "004":
+		if u.PwNonce == "" {
+			return fmt.Errorf("Missing pw_nonce")
+		}
+		u.PwFunc = ""
+		u.PwAlg = ""
+		u.PwCost = 0
+		u.PwKeySize = 0
+		u.PwSalt = ""
+		return nil
 	}
+	return fmt.Errorf("Unsupported protocol version: %s", u.Version)
 }
 
 //save - save current user into DB
-func (u *User) create() error {
+func (u *User) create(store Store) error {
 	if u.UUID != "" {
 		return fmt.Errorf("Trying to save existing user")
 	}
@@ -114,15 +135,23 @@ func (u *User) create() error {
 		return fmt.Errorf("Empty email or password")
 	}
 
-	if u.Exists() {
+	if u.Exists(store) {
 		return fmt.Errorf("Unable to register")
 	}
 
+	if err := u.validateParams(); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(u.Password)
+	if err != nil {
+		return err
+	}
 	u.UUID = uuid.Must(uuid.NewV4()).String()
-	u.Password = Hash(u.Password)
+	u.Password = hash
 	u.CreatedAt = time.Now()
 
-	err := db.Query("INSERT INTO users (uuid, email, password, pw_func, pw_alg, pw_cost, pw_key_size, pw_nonce, pw_auth, pw_salt, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)", u.UUID, u.Email, u.Password, u.PwFunc, u.PwAlg, u.PwCost, u.PwKeySize, u.PwNonce, u.PwAuth, u.PwSalt, u.CreatedAt, u.UpdatedAt)
+	err = store.CreateUser(u)
 
 	if err != nil {
 		Log(err)
@@ -132,36 +161,113 @@ func (u *User) create() error {
 }
 
 //UpdatePassword - update password
-func (u *User) UpdatePassword(np NewPassword) error {
+func (u *User) UpdatePassword(store Store, np NewPassword) error {
+	if err := u.setCredentials(np); err != nil {
+		return err
+	}
+
+	// TODO: validate incomming pw params
+	err := store.UpdateUser(u)
+
+	if err != nil {
+		Log(err)
+		return err
+	}
+
+	return u.signOutEverywhere(store)
+}
+
+//ChangeEmail - changes email together with the password and key params derived from it
+func (u *User) ChangeEmail(store Store, np NewPassword) error {
+	email := strings.TrimSpace(np.NewEmail)
+	if email == "" {
+		return fmt.Errorf("Empty email")
+	}
+	if err := u.setCredentials(np); err != nil {
+		return err
+	}
+	u.Email = email
+
+	if err := store.ChangeEmail(u); err != nil {
+		Log(err)
+		return err
+	}
+
+	return u.signOutEverywhere(store)
+}
+
+//signOutEverywhere - revokes sessions and API tokens after credentials change,
+//signed in devices have to sign in with the new password
+func (u User) signOutEverywhere(store Store) error {
+	if err := store.DeleteUserSessions(u.UUID, ""); err != nil {
+		return err
+	}
+	return store.DeleteUserAPITokens(u.UUID)
+}
+
+//setCredentials - sets new password hash and key params
+func (u *User) setCredentials(np NewPassword) error {
 	if u.UUID == "" {
 		return fmt.Errorf("Unknown user")
 	}
 
-	u.Password = Hash(np.NewPassword)
+	hash, err := hashPassword(np.NewPassword)
+	if err != nil {
+		return err
+	}
+	u.Password = hash
 	u.PwCost = np.PwCost
 	u.PwSalt = np.PwSalt
 	u.PwNonce = np.PwNonce
+	// clients upgrade protocol version by changing password with new key params
+	if np.Version != "" {
+		u.Version = np.Version
+	}
+	if err := u.validateParams(); err != nil {
+		return err
+	}
 
 	u.UpdatedAt = time.Now()
-	// TODO: validate incomming pw params
-	err := db.Query("UPDATE `users` SET `password`=?, `pw_cost`=?, `pw_salt`=?, `pw_nonce`=?, `updated_at`=? WHERE `uuid`=?", u.Password, u.PwCost, u.PwSalt, u.PwNonce, u.UpdatedAt, u.UUID)
+	return nil
+}
 
-	if err != nil {
+//Delete - removes the user with all their data
+func (u *User) Delete(store Store) error {
+	if u.UUID == "" {
+		return fmt.Errorf("Unknown user")
+	}
+	if err := store.DeleteUser(u.UUID); err != nil {
 		Log(err)
 		return err
 	}
-
+	log.Println("Deleted user", u.UUID)
 	return nil
 }
 
+//PurgeUser - deletes user with given email from command line
+func PurgeUser(email string) {
+	db.Init(cfg.DBDriver, dbDSN())
+	runMigrations()
+	store := NewSQLStore(db.Default())
+
+	user := NewUser()
+	if user.loadByEmail(store, email); user.UUID == "" {
+		log.Fatal("Unknown user: ", email)
+	}
+	if err := user.Delete(store); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Deleted", email, "with all their data")
+}
+
 //UpdateParams - update params
-func (u *User) UpdateParams(p Params) error {
+func (u *User) UpdateParams(store Store, p Params) error {
 	if u.UUID == "" {
 		return fmt.Errorf("Unknown user")
 	}
 
 	u.UpdatedAt = time.Now()
-	err := db.Query("UPDATE `users` SET `pw_func`=?, `pw_alg`=?, `pw_cost`=?, `pw_key_size`=?, `pw_salt`=?, `updated_at`=? WHERE `uuid`=?", u.PwFunc, u.PwAlg, u.PwCost, u.PwKeySize, u.PwSalt, time.Now(), u.UUID)
+	err := store.UpdateUser(u)
 
 	if err != nil {
 		Log(err)
@@ -171,105 +277,149 @@ func (u *User) UpdateParams(p Params) error {
 	return nil
 }
 
-//Register - creates user and returns token
-func (u *User) Register() (string, error) {
-	err := u.create()
+//Register - creates user and signs in the client
+func (u *User) Register(store Store, invite string, client Client) (SessionTokens, error) {
+	if invitesRequired {
+		if err := checkInvite(store, invite); err != nil {
+			return SessionTokens{}, err
+		}
+	}
+
+	err := u.create(store)
 	if err != nil {
-		return "", err
+		return SessionTokens{}, err
 	}
 
-	token, err := u.Login(u.Email, u.Password)
+	if invitesRequired {
+		// the invite could be used up by concurrent registration after it was checked
+		if err := store.RedeemInvite(invite); err != nil {
+			u.Delete(store)
+			return SessionTokens{}, err
+		}
+	}
+
+	tokens, err := u.startSession(store, client)
 	if err != nil {
-		return "", fmt.Errorf("Registration failed")
+		Log(err)
+		return SessionTokens{}, fmt.Errorf("Registration failed")
 	}
 
-	return token, nil
+	return tokens, nil
 }
 
 //Exists - checks if current user exists in DB
-func (u User) Exists() bool {
-	uuid, err := db.SelectFirst("SELECT `uuid` FROM `users` WHERE `email`=?", u.Email)
+func (u User) Exists(store Store) bool {
+	_, err := store.UserByEmail(u.Email)
 
 	if err != nil {
 		Log(err)
 		return false
 	}
 
-	return uuid != ""
+	return true
 }
 
-//Login - logins user
-func (u *User) Login(email, password string) (string, error) {
-	u.loadByEmailAndPassword(email, Hash(password))
+//Login - logins user, starting new session for the client. mfa holds second factor codes by parameter name
+func (u *User) Login(store Store, email, password string, mfa map[string]string, client Client) (SessionTokens, error) {
+	if err := loginAttempts.check(email, client.IP); err != nil {
+		return SessionTokens{}, err
+	}
 
-	if u.UUID == "" {
-		return "", fmt.Errorf("Invalid email or password")
+	if err := u.checkPassword(store, email, password); err != nil {
+		if lockout := loginAttempts.failed(email, client.IP); lockout != nil {
+			return SessionTokens{}, lockout
+		}
+		return SessionTokens{}, err
 	}
 
-	token, err := u.CreateToken()
-	if err != nil {
-		return "", err
+	if err := u.checkMFA(store, mfa); err != nil {
+		if e, ok := err.(mfaError); ok && e.tag == mfaInvalidTag {
+			if lockout := loginAttempts.failed(email, client.IP); lockout != nil {
+				return SessionTokens{}, lockout
+			}
+		}
+		return SessionTokens{}, err
 	}
 
-	return token, nil
+	loginAttempts.succeeded(email)
+	u.notifySignIn(store, client)
+	return u.startSession(store, client)
 }
 
-//LoadByUUID - loads user info from DB
-func (u *User) LoadByUUID(uuid string) bool {
-	_, err := db.SelectStruct(fmt.Sprintf("SELECT %s FROM `users` WHERE `uuid`=?", sqlstruct.Columns(User{})), u, uuid)
+//checkPassword - loads user with given email and password, legacy password hash is upgraded on success
+func (u *User) checkPassword(store Store, email, password string) error {
+	user, err := store.UserByEmail(email)
 	if err != nil {
-		Log("Load err:", err)
-		return false
+		Log(err)
+		// takes as long as the check of existing user, so emails can't be probed by timing
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return fmt.Errorf("Invalid email or password")
 	}
-
-	return true
-}
-
-//CreateToken - will create JWT token
-func (u User) CreateToken() (string, error) {
-	claims := UserClaims{
-		u.UUID,
-		u.Password,
-		jwt.StandardClaims{
-			IssuedAt: time.Now().Unix(),
-		},
+	if !user.VerifyPassword(password) {
+		return fmt.Errorf("Invalid email or password")
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(SigningKey)
-	if err != nil {
-		return "", err
+	if user.Disabled {
+		return fmt.Errorf("This account has been disabled")
 	}
-
-	return tokenString, nil
+	if !isBcrypt(user.Password) {
+		if hash, err := hashPassword(password); err == nil {
+			user.Password = hash
+			if err := store.UpdateUser(&user); err != nil {
+				log.Println("Password rehash failed:", err)
+			}
+		}
+	}
+	*u = user
+	return nil
 }
 
-func (u *User) loadByEmail(email string) {
-	_, err := db.SelectStruct("SELECT * FROM `users` WHERE `email`=?", u, email)
+//LoadByUUID - loads user info from DB
+func (u *User) LoadByUUID(store Store, uuid string) bool {
+	user, err := store.UserByUUID(uuid)
 	if err != nil {
-		Log(err)
+		Log("Load err:", err)
+		return false
 	}
+
+	*u = user
+	return true
 }
 
-func (u *User) loadByEmailAndPassword(email, password string) {
-	_, err := db.SelectStruct("SELECT * FROM `users` WHERE `email`=? AND `password`=?", u, email, password)
+func (u *User) loadByEmail(store Store, email string) {
+	user, err := store.UserByEmail(email)
 	if err != nil {
 		Log(err)
+		return
 	}
+	*u = user
 }
 
 //GetParams returns auth parameters by email
-func (u User) GetParams(email string) map[string]interface{} {
-	u.loadByEmail(email)
+func (u User) GetParams(store Store, email string) (map[string]interface{}, error) {
+	u.loadByEmail(store, email)
 	params := map[string]interface{}{}
 
 	if u.Email == "" {
-		return params
+		fake, err := fakeUser(email)
+		if err != nil {
+			return nil, err
+		}
+		u = fake
+	}
+
+	params["identifier"] = u.Email
+
+	if u.Version == "004" {
+		params["version"] = u.Version
+		params["pw_nonce"] = u.PwNonce
+		return params, nil
 	}
 
 	params["version"] = "003"
+	if u.Version != "" {
+		params["version"] = u.Version
+	}
 	params["pw_cost"] = u.PwCost
-	params["identifier"] = u.Email
 
 	if u.PwFunc != "" {
 		params["pw_func"] = u.PwFunc
@@ -290,16 +440,36 @@ func (u User) GetParams(email string) map[string]interface{} {
 	}
 	params["pw_salt"] = u.PwSalt
 
-	return params
+	return params, nil
+}
+
+//fakeUser - params of unknown email are the same on every request, so they can't be told apart from existing account.
+//New accounts are registered with 004, so unknown emails get 004 params too
+func fakeUser(email string) (User, error) {
+	key, err := keys.dataKey()
+	if err != nil {
+		return User{}, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("auth params:" + strings.ToLower(email)))
+	u := User{}
+	u.Email = email
+	u.Version = "004"
+	u.PwNonce = hex.EncodeToString(mac.Sum(nil))
+	return u, nil
 }
 
 func getSalt(email, nonce string) string {
 	return strings.Replace(fmt.Sprintf("% x", sha1.Sum([]byte(email+"SN"+nonce))), " ", "", -1)
 }
 
-//Validate - validates password from jwt
-func (u User) Validate(password string) bool {
-	return password == u.Password
+//VerifyPassword - checks password against the stored hash in constant time
+func (u User) VerifyPassword(password string) bool {
+	if isBcrypt(u.Password) {
+		return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(legacyHash(password))) == nil
+	}
+	// accounts which haven't signed in since bcrypt was introduced
+	return u.Password != "" && subtle.ConstantTimeCompare([]byte(u.Password), []byte(legacyHash(password))) == 1
 }
 
 //ToJSON - return map without pw and nonce
@@ -309,7 +479,21 @@ func (u User) ToJSON() interface{} {
 	return u
 }
 
-//Hash - sha256 hash function
-func Hash(input string) string {
+//dummyHash - bcrypt hash compared when user doesn't exist
+var dummyHash = []byte("$2a$10$mXUi5YDBJbH0w2xbDs7AfunbcAhrB.3OV5RWScVrbG3rymkhHBAJK")
+
+//hashPassword - bcrypt hash of the password. The password is sha256 hashed first,
+//which keeps it within bcrypt's 72 bytes limit and allows to rehash legacy hashes
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(legacyHash(password)), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2")
+}
+
+//legacyHash - unsalted sha256, used to store passwords before bcrypt
+func legacyHash(input string) string {
 	return strings.Replace(fmt.Sprintf("% x", sha256.Sum256([]byte(input))), " ", "", -1)
 }
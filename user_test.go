@@ -1,9 +1,19 @@
 package main_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
 	sf "github.com/tectiv3/standardfile"
 	"github.com/tectiv3/standardfile/db"
-	"testing"
+	"github.com/tectiv3/standardfile/db/pgtest"
 )
 
 var (
@@ -20,28 +30,349 @@ var (
 		PwKeySize: 512,
 		PwFunc:    "pbkdf2",
 	}
+	sqliteDB    *db.Database
+	sqliteStore sf.Store
+	sqliteErr   error
+	// postgres is opened by TestMain
+	postgres = sqlBackend{name: "postgres"}
 )
 
 func init() {
-	db.Init(":memory:")
+	sqliteDB, sqliteErr = db.Open(db.SQLite, "file:user_test?mode=memory&cache=shared")
+	if sqliteErr == nil {
+		sqliteStore = sf.NewSQLStore(sqliteDB)
+	}
 }
 
-func TestRegister(t *testing.T) {
-	var user = register
-	token, err := user.Register()
+func useSQLite(t *testing.T) *sf.Server {
+	if sqliteErr != nil {
+		t.Skip("sqlite is not available:", sqliteErr)
+	}
+	return sf.NewServer(sqliteStore)
+}
+
+//sqlBackend - database of one driver with its store
+type sqlBackend struct {
+	name  string
+	db    *db.Database
+	store sf.Store
+	err   error
+}
+
+//openPostgres - starts postgres for the tests, returned function stops it
+func openPostgres() func() {
+	dsn, stop, err := pgtest.Start()
 	if err != nil {
-		t.Error("Register failed", err)
-		return
+		postgres.err = err
+		return func() {}
 	}
-	t.Log("Token:", token)
+	if postgres.db, postgres.err = db.Open(db.Postgres, dsn); postgres.err == nil {
+		postgres.store = sf.NewSQLStore(postgres.db)
+	}
+	return stop
+}
+
+//eachSQLStore - runs test against sqlite and postgres, drivers which are not available are skipped
+func eachSQLStore(t *testing.T, fn func(t *testing.T, b sqlBackend)) {
+	for _, b := range []sqlBackend{{"sqlite", sqliteDB, sqliteStore, sqliteErr}, postgres} {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			if b.err != nil {
+				t.Skip(b.err)
+			}
+			fn(t, b)
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		var user = register
+		tokens, err := user.Register(b.store, "", sf.Client{})
+		if err != nil {
+			t.Error("Register failed", err)
+			return
+		}
+		t.Log("Token:", tokens.AccessToken)
+	})
 }
 
 func TestLogin(t *testing.T) {
-	var user = login
-	token, err := user.Login(user.Email, user.Password)
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		var user = login
+		tokens, err := user.Login(b.store, user.Email, user.Password, nil, sf.Client{})
+		if err != nil {
+			t.Error("Login failed", err)
+			return
+		}
+		t.Log("Token:", tokens.AccessToken)
+	})
+}
+
+func TestSyncBatchSQL(t *testing.T) {
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		srv := sf.NewServer(b.store)
+		token := registerUser(t, srv, "batch@local")
+
+		_, res := request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"batch-1","content":"001abc","content_type":"Note"},{"uuid":"batch-2","content":"001abc","content_type":"Note"}]}`)
+		if len(res["saved_items"].([]interface{})) != 2 {
+			t.Fatal("Items were not saved:", res)
+		}
+
+		failing := sf.NewServer(failingStore{b.store, "batch-4"})
+		code, _ := request(t, failing.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"batch-1","deleted":true},{"uuid":"batch-3","content":"001abc","content_type":"Note"},{"uuid":"batch-4","content":"001abc","content_type":"Note"}]}`)
+		if code == http.StatusAccepted {
+			t.Error("Sync should fail when the batch can't be saved")
+		}
+		_, res = request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[]}`)
+		retrieved := res["retrieved_items"].([]interface{})
+		if len(retrieved) != 2 || retrieved[0].(map[string]interface{})["deleted"] == true || retrieved[1].(map[string]interface{})["deleted"] == true {
+			t.Error("Failed batch should be rolled back:", retrieved)
+		}
+	})
+}
+
+func TestRevisionsSQL(t *testing.T) {
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		srv := sf.NewServer(b.store)
+		_, res := request(t, srv.Registration, "POST", "/api/auth", "", `{"email":"revisions@local","password":"secret","pw_cost":110000,"pw_nonce":"nonce"}`)
+		token := res["token"].(string)
+		for _, content := range []string{"001abc", "002abc", "003abc"} {
+			request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"rev-1","content":"`+content+`","content_type":"Note"}]}`)
+		}
+		user := sf.NewUser()
+		user.LoadByUUID(b.store, res["user"].(map[string]interface{})["uuid"].(string))
+		revisions, err := user.GetRevisions(b.store, "rev-1")
+		if err != nil || len(revisions) != 2 || revisions[0].Content != "002abc" {
+			t.Fatal("Unexpected revisions:", err, revisions)
+		}
+		if r, err := user.GetRevision(b.store, "rev-1", revisions[1].UUID); err != nil || r.Content != "001abc" {
+			t.Error("Unexpected revision:", err, r)
+		}
+	})
+}
+
+func TestBackupItemsSQL(t *testing.T) {
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		srv := sf.NewServer(b.store)
+		token := registerUser(t, srv, "backup@local")
+		request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"backup-1","content":"001abc","content_type":"Note"},{"uuid":"backup-2","content":"001abc","content_type":"Tag"},{"uuid":"backup-3","content":"001abc","content_type":"SN|Component"}]}`)
+
+		code, res := request(t, srv.BackupItems, "POST", "/api/items/backup?content_type=Note,Tag", token, "")
+		items := res["items"].([]interface{})
+		if code != http.StatusOK || len(items) != 2 {
+			t.Error("Unexpected backup:", code, res)
+		}
+
+		notes := []string{}
+		for i := 0; i < 250; i++ {
+			notes = append(notes, fmt.Sprintf(`{"uuid":"backup-page-%03d","content":"001abc","content_type":"Note"}`, i))
+		}
+		request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[`+strings.Join(notes, ",")+`]}`)
+		// client reading the backup slowly must not block other users' writes
+		w := &syncingWriter{ResponseRecorder: httptest.NewRecorder(), sync: func() int {
+			return status(srv.SyncItems, "POST", "/api/items/sync", registerUser(t, srv, "backup-writer@local"), `{"items":[{"uuid":"backup-writer-1","content":"001abc","content_type":"Note"}]}`)
+		}}
+		r := httptest.NewRequest("GET", "/api/items/backup?content_type=Note", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		srv.BackupItems(w, r)
+		backup := struct {
+			Items []sf.Item `json:"items"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &backup); err != nil || len(backup.Items) != 251 {
+			t.Fatal("Backup should contain every page:", len(backup.Items), err)
+		}
+		seen := map[string]bool{}
+		for _, i := range backup.Items {
+			seen[i.UUID] = true
+		}
+		if len(seen) != 251 {
+			t.Error("Items should be backed up once:", len(seen))
+		}
+		if w.synced != http.StatusAccepted {
+			t.Error("Sync during backup failed:", w.synced)
+		}
+	})
+}
+
+//syncingWriter - response writer saving items of another user while the first item is written
+type syncingWriter struct {
+	*httptest.ResponseRecorder
+	sync   func() int
+	writes int
+	synced int
+}
+
+func (w *syncingWriter) Write(b []byte) (int, error) {
+	if w.writes++; w.writes == 2 {
+		w.synced = w.sync()
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestDeleteUserSQL(t *testing.T) {
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		srv := sf.NewServer(b.store)
+		_, res := request(t, srv.Registration, "POST", "/api/auth", "", `{"email":"delete@local","password":"secret","pw_cost":110000,"pw_nonce":"nonce"}`)
+		token := res["token"].(string)
+		for _, content := range []string{"001abc", "002abc"} {
+			request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"delete-sqlite-1","content":"`+content+`","content_type":"Note"}]}`)
+		}
+		user := sf.NewUser()
+		user.LoadByUUID(b.store, res["user"].(map[string]interface{})["uuid"].(string))
+		if err := user.Delete(b.store); err != nil {
+			t.Fatal("Delete failed:", err)
+		}
+		for _, table := range []string{"users", "items", "revisions", "sessions"} {
+			column := "user_uuid"
+			if table == "users" {
+				column = "uuid"
+			}
+			count, err := b.db.SelectFirst("SELECT COUNT(*) FROM `"+table+"` WHERE `"+column+"`=?", user.UUID)
+			if err != nil || count != "0" {
+				t.Error("Rows of deleted user left in", table, count, err)
+			}
+		}
+	})
+}
+
+func TestInvitesSQL(t *testing.T) {
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		b.store.CreateInvite(&sf.Invite{Code: "TWICE", MaxUses: 2, CreatedAt: time.Now(), UpdatedAt: time.Now()})
+		b.store.CreateInvite(&sf.Invite{Code: "EXPIRED", ExpiresAt: time.Now().Add(-time.Minute), CreatedAt: time.Now(), UpdatedAt: time.Now()})
+
+		for i := 0; i < 2; i++ {
+			if err := b.store.RedeemInvite("TWICE"); err != nil {
+				t.Fatal("Redeem failed:", err)
+			}
+		}
+		if err := b.store.RedeemInvite("TWICE"); err == nil {
+			t.Error("Used up invite should not be redeemed")
+		}
+		if err := b.store.RedeemInvite("EXPIRED"); err == nil {
+			t.Error("Expired invite should not be redeemed")
+		}
+		if i, err := b.store.InviteByCode("TWICE"); err != nil || i.Uses != 2 || !i.ExpiresAt.IsZero() {
+			t.Error("Unexpected invite:", i, err)
+		}
+		if err := b.store.DeleteInvite("EXPIRED"); err != nil {
+			t.Fatal(err)
+		}
+		if invites, err := b.store.Invites(); err != nil || len(invites) != 1 {
+			t.Error("Unexpected invites:", invites, err)
+		}
+	})
+}
+
+func TestUserStatsSQL(t *testing.T) {
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		srv := sf.NewServer(b.store)
+		_, res := request(t, srv.Registration, "POST", "/api/auth", "", `{"email":"stats@local","password":"secret","pw_cost":110000,"pw_nonce":"nonce"}`)
+		token := res["token"].(string)
+		request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"stats-1","content":"001abc","content_type":"Note","enc_item_key":"key"},{"uuid":"stats-2","content":"001abc","content_type":"Note"},{"uuid":"stats-3","content":"001","content_type":"Tag"}]}`)
+		request(t, srv.SyncItems, "POST", "/api/items/sync", token, `{"items":[{"uuid":"stats-1","content":"002abc","content_type":"Note","enc_item_key":"key"},{"uuid":"stats-3","deleted":true}]}`)
+
+		uuid := res["user"].(map[string]interface{})["uuid"].(string)
+		stats, err := b.store.UserStats(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Items != 2 || stats.DeletedItems != 1 || stats.ContentTypes["Note"] != 2 || stats.ContentTypes["Tag"] != 0 {
+			t.Error("Unexpected item counts:", stats)
+		}
+		if stats.Size != 15 || stats.Revisions != 1 || stats.RevisionsSize != 9 {
+			t.Error("Unexpected sizes:", stats)
+		}
+	})
+}
+
+func TestAPITokensSQL(t *testing.T) {
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		srv := sf.NewServer(b.store)
+		token := registerUser(t, srv, "tokens@local")
+		_, res := request(t, srv.CreateAPIToken, "POST", "/api/tokens", token, `{"name":"bot","scopes":["items:read"],"expires_at":"2100-01-01T00:00:00Z"}`)
+		bot, _ := res["token"].(string)
+		if code := status(srv.SyncItems, "POST", "/api/items/sync", bot, `{"items":[]}`); code != http.StatusAccepted {
+			t.Fatal("Sync with API token failed:", code, res)
+		}
+		user, _ := b.store.UserByEmail("tokens@local")
+		tokens, err := b.store.UserAPITokens(user.UUID)
+		if err != nil || len(tokens) != 1 || tokens[0].LastUsedAt.IsZero() || tokens[0].ExpiresAt.Year() != 2100 {
+			t.Error("Unexpected API tokens:", tokens, err)
+		}
+		if err := user.Delete(b.store); err != nil {
+			t.Fatal(err)
+		}
+		if code := status(srv.SyncItems, "POST", "/api/items/sync", bot, `{"items":[]}`); code != http.StatusUnauthorized {
+			t.Error("API token of deleted user should be rejected:", code)
+		}
+	})
+}
+
+func TestBackupSnapshotSQLite(t *testing.T) {
+	srv := useSQLite(t)
+	registerUser(t, srv, "snapshot@local")
+	dir := t.TempDir()
+	if err := sf.RunBackups(sqliteStore, sf.NewDirTarget(dir), time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal("Backup failed:", err)
+	}
+	snapshot, err := db.Open(db.SQLite, filepath.Join(dir, "db", "2026-03-01.db"))
 	if err != nil {
-		t.Error("Login failed", err)
-		return
+		t.Fatal("Snapshot should be written:", err)
+	}
+	count, err := snapshot.SelectFirst("SELECT COUNT(*) FROM `users` WHERE `email`=?", "snapshot@local")
+	if err != nil || count != "1" {
+		t.Error("Snapshot should contain users:", count, err)
+	}
+}
+
+func TestSettingsSQL(t *testing.T) {
+	eachSQLStore(t, func(t *testing.T, b sqlBackend) {
+		srv := sf.NewServer(b.store)
+		token := registerUser(t, srv, "settings@local")
+		if _, res := request(t, srv.ShowSettings, "GET", "/api/settings", token, ""); res["sign_in_alerts"] != true || res["email_backups"] != false {
+			t.Error("Unexpected default settings:", res)
+		}
+		request(t, srv.UpdateSettings, "POST", "/api/settings", token, `{"email_backups":true}`)
+		request(t, srv.UpdateSettings, "POST", "/api/settings", token, `{"sign_in_alerts":false}`)
+		if _, res := request(t, srv.ShowSettings, "GET", "/api/settings", token, ""); res["sign_in_alerts"] != false || res["email_backups"] != true {
+			t.Error("Settings should be saved:", res)
+		}
+	})
+}
+
+func TestAdminSnapshotSQLite(t *testing.T) {
+	srv := useSQLite(t)
+	registerUser(t, srv, "admin-snapshot@local")
+	sf.UseAdminToken("0123456789abcdef-admin")
+	defer sf.UseAdminToken("")
+
+	snapshot := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/admin/snapshot", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		srv.AdminSnapshot(w, r)
+		return w
+	}
+	if w := snapshot("wrong"); w.Code != http.StatusUnauthorized {
+		t.Error("Snapshot should require admin token:", w.Code)
+	}
+	w := snapshot("0123456789abcdef-admin")
+	if w.Code != http.StatusOK {
+		t.Fatal("Snapshot failed:", w.Code, w.Body.String())
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	ioutil.WriteFile(path, w.Body.Bytes(), 0600)
+	if err := db.CheckIntegrity(path); err != nil {
+		t.Error("Snapshot should pass integrity check:", err)
+	}
+	restored, _ := db.Open(db.SQLite, path)
+	if count, err := restored.SelectFirst("SELECT COUNT(*) FROM `users` WHERE `email`=?", "admin-snapshot@local"); err != nil || count != "1" {
+		t.Error("Snapshot should contain users:", count, err)
+	}
+
+	srv = sf.NewServer(sf.NewMemoryStore())
+	if w := snapshot("0123456789abcdef-admin"); w.Code != http.StatusNotImplemented {
+		t.Error("Memory store has no snapshots:", w.Code)
 	}
-	t.Log("Token:", token)
 }
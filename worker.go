@@ -16,7 +16,20 @@ import (
 )
 
 func worker() {
-	db.Init(cfg.DB)
+	db.Init(cfg.DBDriver, dbDSN())
+	runMigrations()
+	srv := NewServer(NewSQLStore(db.Default()))
+	RequireInvites(cfg.Invites)
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < 16 {
+		log.Fatal("admin_token must be at least 16 characters long")
+	}
+	UseAdminToken(cfg.AdminToken)
+	if err := UseTrustedProxies(cfg.Proxies); err != nil {
+		log.Fatal(err)
+	}
+	if err := LoadKeys(cfg.KeyFile); err != nil {
+		log.Fatal(err)
+	}
 	log.Println("Started StandardFile Server", Version)
 	log.Println("Loaded config:", loadedConfig)
 
@@ -24,6 +37,34 @@ func worker() {
 		log.Println("Debug on")
 	}
 
+	if err := startBackups(srv.store); err != nil {
+		log.Fatal(err)
+	}
+	if err := startMailer(srv.store); err != nil {
+		log.Fatal(err)
+	}
+
+	r := srv.Router()
+
+	defer removeSock()
+	go listen(r)
+	<-run
+	log.Println("Server stopped")
+	os.Exit(0)
+}
+
+//Server - serves the API from its store, handlers and models get no storage but the server's one
+type Server struct {
+	store Store
+}
+
+//NewServer - creates server of the store
+func NewServer(store Store) *Server {
+	return &Server{store: store}
+}
+
+//Router - registers handlers of all routes
+func (srv *Server) Router() *pure.Mux {
 	r := pure.New()
 	if cfg.UseCORS {
 		r.Use(mw.LoggingAndRecovery(true), cors)
@@ -32,25 +73,44 @@ func worker() {
 		r.Use(mw.LoggingAndRecovery(true))
 	}
 
-	r.Get("/", Dashboard)
-	r.Post("/api/items/sync", SyncItems)
-	r.Post("/api/items/backup", BackupItems)
+	r.Get("/", srv.Dashboard)
+	r.Post("/api/items/sync", srv.SyncItems)
+	r.Post("/api/items/backup", srv.BackupItems)
+	r.Post("/api/items/import", srv.ImportItems)
+	// router doesn't allow static GET routes next to :uuid, backup is served by ItemRoute
+	r.Get("/api/items/:uuid", srv.ItemRoute)
+	r.Get("/api/items/:uuid/revisions", srv.ItemRevisions)
+	r.Get("/api/items/:uuid/revisions/:id", srv.ItemRevision)
 	// r.DELETE("/api/items", DeleteItems)
 	if !cfg.NoReg {
-		r.Post("/api/auth", Registration)
+		r.Post("/api/auth", srv.Registration)
 	}
-	r.Patch("/api/auth", ChangePassword)
-	r.Post("/api/auth/update", UpdateUser)
-	r.Post("/api/auth/change_pw", ChangePassword)
-	r.Post("/api/auth/sign_in", Login)
-	r.Post("/api/auth/sign_in.json", Login)
-	r.Get("/api/auth/params", GetParams)
-
-	defer removeSock()
-	go listen(r)
-	<-run
-	log.Println("Server stopped")
-	os.Exit(0)
+	r.Patch("/api/auth", srv.ChangePassword)
+	r.Delete("/api/auth", srv.DeleteAccount)
+	r.Post("/api/auth/update", srv.UpdateUser)
+	r.Post("/api/auth/change_pw", srv.ChangePassword)
+	r.Post("/api/auth/change_email", srv.ChangeEmail)
+	r.Post("/api/auth/sign_in", srv.Login)
+	r.Post("/api/auth/sign_in.json", srv.Login)
+	r.Get("/api/auth/params", srv.GetParams)
+	r.Post("/api/auth/sign_out", srv.SignOut)
+	r.Get("/api/sessions", srv.ListSessions)
+	r.Delete("/api/session", srv.RevokeSession)
+	r.Delete("/api/session/all", srv.RevokeOtherSessions)
+	r.Post("/api/session/refresh", srv.RefreshSession)
+	r.Get("/api/mfa", srv.MFAStatus)
+	r.Post("/api/mfa", srv.StartMFA)
+	r.Post("/api/mfa/enable", srv.EnableMFA)
+	r.Delete("/api/mfa", srv.DisableMFA)
+	r.Get("/api/tokens", srv.ListAPITokens)
+	r.Post("/api/tokens", srv.CreateAPIToken)
+	r.Delete("/api/tokens", srv.RevokeAPIToken)
+	r.Get("/api/settings", srv.ShowSettings)
+	r.Post("/api/settings", srv.UpdateSettings)
+	if adminToken != "" {
+		r.Post("/api/admin/snapshot", srv.AdminSnapshot)
+	}
+	return r
 }
 
 func listen(r *pure.Mux) {